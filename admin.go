@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/anachronistic/apns"
+	"github.com/zenazn/goji/web"
+	"gopkg.in/mgo.v2"
+)
+
+const (
+	RoleReadOnly = "read-only"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var roleRanks = map[string]int{
+	RoleReadOnly: 1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+var AdminUnauthorizedError = NewUnauthorizedError("Admin credentials are missing or incorrect.")
+var WebhookNotFoundError = NewNotFoundError("No archived webhook has that id.")
+var AdminAccountInvalidError = NewValidationError("POST to /admin/accounts must be a JSON with a Name and a Role of read-only, operator or admin.")
+var AdminAccountConflictError = NewConflictError("An admin account with that name already exists.")
+var AdminAccountNotFoundError = NewNotFoundError("No admin account has that name.")
+var DeviceNotFoundError = NewNotFoundError("No device has that id.")
+var TestNotificationInvalidError = NewValidationError("POST to /admin/devices/:deviceId/notifications may only send a JSON with an Alert.")
+var SubscriptionNotFoundError = NewNotFoundError("The device is not subscribed to that repository.")
+
+type AdminCredentials struct {
+	Name string
+	Role string
+	Key  string
+}
+
+type RepositorySummary struct {
+	Name    string
+	Devices int
+	Users   int
+}
+
+type TestNotification struct {
+	DeviceId string
+	Alert    string
+}
+
+func (self *SidewinderDirector) RequireRole(role string, handler RestHandler) RestHandler {
+	return func(context web.C, writer http.ResponseWriter, request *http.Request) error {
+		adminRole, err := self.adminRole(request)
+		if err != nil {
+			return err
+		} else if adminRole == "" {
+			return AdminUnauthorizedError
+		} else if roleRanks[adminRole] < roleRanks[role] {
+			return NewForbiddenError("This requires the " + role + " role.")
+		}
+		return handler(context, writer, request)
+	}
+}
+
+func (self *SidewinderDirector) adminRole(request *http.Request) (string, error) {
+	token := bearerToken(request)
+	if token == "" {
+		return "", nil
+	} else if self.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(self.AdminToken)) == 1 {
+		return RoleAdmin, nil
+	}
+
+	admin, err := self.StoreWith(request.Context()).FindAdminByKeyHash(hashKey(token))
+	if err == mgo.ErrNotFound {
+		return "", nil
+	}
+	return admin.Role, err
+}
+
+func bearerToken(request *http.Request) string {
+	authorization := request.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+}
+
+func (self *SidewinderDirector) AdminAccountMux() *RestEndpoint {
+	return (&RestEndpoint{
+		Get:  self.RequireRole(RoleAdmin, self.ListAdmins),
+		Post: self.RequireRole(RoleAdmin, self.AddAdmin),
+		Docs: map[string]Operation{
+			"GET":  {Summary: "List admin accounts.", Response: []AdminDocument{}},
+			"POST": {Summary: "Add an admin account.", Status: 201, Request: AdminDocument{}, Response: AdminCredentials{}},
+		},
+	}).Route("/:name", RestEndpoint{
+		Delete: self.RequireRole(RoleAdmin, self.DeleteAdmin),
+		Docs: map[string]Operation{
+			"DELETE": {Summary: "Remove an admin account.", Response: AdminDocument{}},
+		},
+	})
+}
+
+func (self *SidewinderDirector) ListAdmins(context web.C, writer http.ResponseWriter, request *http.Request) error {
+	admins, err := self.StoreWith(request.Context()).AllAdmins()
+	if err != nil {
+		return err
+	}
+	return writeJson(200, admins, writer, request)
+}
+
+func (self *SidewinderDirector) AddAdmin(context web.C, writer http.ResponseWriter, request *http.Request) error {
+	var sentJSON AdminDocument
+	violations, err := decodeJson(request, &sentJSON)
+	if err != nil {
+		return err
+	}
+	violations.Check(sentJSON.Name != "", "Name is required.")
+	violations.Check(roleRanks[sentJSON.Role] != 0, "Role must be read-only, operator or admin.")
+	if err := violations.Refusal(AdminAccountInvalidError); err != nil {
+		return err
+	}
+
+	key, err := newKey()
+	if err != nil {
+		return err
+	}
+	recordWasCreated, err := self.StoreWith(request.Context()).AddAdmin(sentJSON.Name, hashKey(key), sentJSON.Role)
+	if err != nil {
+		return err
+	} else if !recordWasCreated {
+		return AdminAccountConflictError
+	}
+	return writeJson(201, AdminCredentials{sentJSON.Name, sentJSON.Role, key}, writer, request)
+}
+
+func (self *SidewinderDirector) DeleteAdmin(context web.C, writer http.ResponseWriter, request *http.Request) error {
+	admin, err := self.StoreWith(request.Context()).FindAdmin(context.URLParams["name"])
+	if err == mgo.ErrNotFound {
+		return AdminAccountNotFoundError
+	} else if err != nil {
+		return err
+	}
+
+	if err := self.StoreWith(request.Context()).DeleteAdmin(admin.Name); err != nil {
+		return err
+	}
+	return writeJson(200, admin, writer, request)
+}
+
+func (self *SidewinderDirector) AdminDeviceMux() *RestEndpoint {
+	return (&RestEndpoint{
+		Get: self.RequireRole(RoleReadOnly, self.ListDevices),
+		Docs: map[string]Operation{
+			"GET": {Summary: "List every device.", Response: []DeviceDocument{}},
+		},
+	}).Route("/:deviceId/repositories", RestEndpoint{
+		Delete: self.RequireRole(RoleOperator, self.ForceUnsubscribe),
+		Docs: map[string]Operation{
+			"DELETE": {Summary: "Unsubscribe a device.", Query: []string{"name"}, Response: SubscriptionMessage{}},
+		},
+	}).Route("/:deviceId/credentials", RestEndpoint{
+		Post: self.RequireRole(RoleOperator, self.IssueDeviceKey),
+		Docs: map[string]Operation{
+			"POST": {Summary: "Issue a new key to a device.", Response: DeviceCredentials{}},
+		},
+	}).Route("/:deviceId/notifications", RestEndpoint{
+		Post: self.RequireRole(RoleOperator, self.SendTestNotification),
+		Docs: map[string]Operation{
+			"POST": {Summary: "Push a test notification to a device.", Status: 201, Request: TestNotification{}, Response: TestNotification{}},
+		},
+	})
+}
+
+func (self *SidewinderDirector) IssueDeviceKey(context web.C, writer http.ResponseWriter, request *http.Request) error {
+	device, err := self.StoreWith(request.Context()).FindDevice(context.URLParams["deviceId"])
+	if err == mgo.ErrNotFound {
+		return DeviceNotFoundError
+	} else if err != nil {
+		return err
+	}
+
+	credentials, err := self.issueDeviceKey(device.DeviceId)
+	if err != nil {
+		return err
+	}
+	return writeJson(200, credentials, writer, request)
+}
+
+func (self *SidewinderDirector) ListDevices(context web.C, writer http.ResponseWriter, request *http.Request) error {
+	devices, err := self.StoreWith(request.Context()).AllDevices()
+	if err != nil {
+		return err
+	}
+	return writeJson(200, devices, writer, request)
+}
+
+func (self *SidewinderDirector) ForceUnsubscribe(context web.C, writer http.ResponseWriter, request *http.Request) error {
+	deviceId := context.URLParams["deviceId"]
+	repositoryName := request.URL.Query().Get("name")
+	err := self.StoreWith(request.Context()).RemoveDeviceFromRepository(deviceId, repositoryName)
+	if err == mgo.ErrNotFound {
+		return SubscriptionNotFoundError
+	} else if err != nil {
+		return err
+	}
+	return writeJson(200, SubscriptionMessage{Name: repositoryName}, writer, request)
+}
+
+func (self *SidewinderDirector) SendTestNotification(context web.C, writer http.ResponseWriter, request *http.Request) error {
+	device, err := self.StoreWith(request.Context()).FindDevice(context.URLParams["deviceId"])
+	if err == mgo.ErrNotFound {
+		return DeviceNotFoundError
+	} else if err != nil {
+		return err
+	}
+
+	var notification TestNotification
+	violations, err := decodeJson(request, &notification)
+	if err != nil {
+		return err
+	} else if err := violations.Refusal(TestNotificationInvalidError); err != nil {
+		return err
+	}
+	notification.DeviceId = device.DeviceId
+	if notification.Alert == "" {
+		notification.Alert = "Test notification from Sidewinder."
+	}
+
+	payload := apns.NewPayload()
+	payload.Alert = notification.Alert
+	if err := self.push(request.Context(), device.DeviceId, payload); err != nil {
+		return err
+	}
+	return writeJson(201, notification, writer, request)
+}
+
+func (self *SidewinderDirector) AdminRepositoryMux() *RestEndpoint {
+	return &RestEndpoint{
+		Get: self.RequireRole(RoleReadOnly, self.ListRepositories),
+		Docs: map[string]Operation{
+			"GET": {Summary: "List every repository with its subscriber counts.", Response: []RepositorySummary{}},
+		},
+	}
+}
+
+func (self *SidewinderDirector) ListRepositories(context web.C, writer http.ResponseWriter, request *http.Request) error {
+	repositories, err := self.StoreWith(request.Context()).AllRepositories()
+	if err != nil {
+		return err
+	}
+
+	summaries := make([]RepositorySummary, 0, len(repositories))
+	for _, repository := range repositories {
+		summaries = append(summaries, RepositorySummary{
+			Name:    repository.Name,
+			Devices: len(repository.DeviceList) + len(repository.AuthorDeviceList),
+			Users:   len(repository.UserList) + len(repository.AuthorUserList),
+		})
+	}
+	return writeJson(200, summaries, writer, request)
+}
+
+func (self *SidewinderDirector) WebhookArchiveMux() *RestEndpoint {
+	return (&RestEndpoint{
+		Get: self.RequireRole(RoleReadOnly, self.ListWebhooks),
+		Docs: map[string]Operation{
+			"GET": {Summary: "List the most recent webhooks.", Query: []string{"limit"}, Response: WebhookDocuments{}},
+		},
+	}).Route("/:webhookId", RestEndpoint{
+		Get: self.RequireRole(RoleReadOnly, self.ShowWebhook),
+		Docs: map[string]Operation{
+			"GET": {Summary: "Show an archived webhook.", Response: WebhookDocument{}},
+		},
+		Paths: map[string]RestEndpoint{
+			"/replay": {
+				Post: self.RequireRole(RoleOperator, self.ReplayWebhook),
+				Docs: map[string]Operation{
+					"POST": {Summary: "Show what an archived webhook would notify.", Response: NotificationDecision{}},
+				},
+			},
+		},
+	})
+}
+func (self *SidewinderDirector) ListWebhooks(context web.C, writer http.ResponseWriter, request *http.Request) error {
+	limit, err := strconv.Atoi(request.URL.Query().Get("limit"))
+	if err != nil || limit < 1 || limit > 500 {
+		limit = 50
+	}
+
+	webhooks, err := self.StoreWith(request.Context()).RecentWebhooks(limit)
+	if err != nil {
+		return err
+	}
+	return writeJson(200, webhooks, writer, request)
+}
+
+func (self *SidewinderDirector) ShowWebhook(context web.C, writer http.ResponseWriter, request *http.Request) error {
+	webhook, err := self.StoreWith(request.Context()).FindWebhook(context.URLParams["webhookId"])
+	if err == mgo.ErrNotFound {
+		return WebhookNotFoundError
+	} else if err != nil {
+		return err
+	}
+	return writeJson(200, webhook, writer, request)
+}
+
+func (self *SidewinderDirector) ReplayWebhook(context web.C, writer http.ResponseWriter, request *http.Request) error {
+	webhook, err := self.StoreWith(request.Context()).FindWebhook(context.URLParams["webhookId"])
+	if err == mgo.ErrNotFound {
+		return WebhookNotFoundError
+	} else if err != nil {
+		return err
+	}
+
+	handler := self.webhooks[webhook.Provider]
+	if handler == nil {
+		return NewValidationError("Webhooks from " + webhook.Provider + " can not be replayed.")
+	}
+
+	replayRequest, err := http.NewRequestWithContext(request.Context(), "POST", "/hooks/"+webhook.Provider, bytes.NewReader([]byte(webhook.Body)))
+	if err != nil {
+		return err
+	}
+	replayRequest.Header = http.Header(webhook.Headers)
+
+	return DryRun(handler)(web.C{URLParams: map[string]string{}}, writer, replayRequest)
+}
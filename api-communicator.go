@@ -4,6 +4,7 @@ import "net/http"
 
 type ApiCommunicator interface {
 	Get(url string) (*http.Response, error)
+	Do(request *http.Request) (*http.Response, error)
 }
 
 type HttpCommunicator struct{}
@@ -11,3 +12,7 @@ type HttpCommunicator struct{}
 func (self HttpCommunicator) Get(url string) (*http.Response, error) {
 	return http.Get(url)
 }
+
+func (self HttpCommunicator) Do(request *http.Request) (*http.Response, error) {
+	return http.DefaultClient.Do(request)
+}
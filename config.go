@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+func durationFromEnv(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%v must be a duration such as \"90m\".\n%v", name, err.Error())
+	}
+	return duration, nil
+}
+
+func intFromEnv(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%v must be a whole number.\n%v", name, err.Error())
+	}
+	return number, nil
+}
+
+func dateFromEnv(name string, fallback time.Time) (time.Time, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%v must be a date such as \"2027-04-19\".\n%v", name, err.Error())
+	}
+	return date, nil
+}
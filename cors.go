@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CorsPolicy struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+func CorsPolicyFromEnv() (CorsPolicy, error) {
+	maxAge, err := durationFromEnv("CORS_MAX_AGE", 10*time.Minute)
+	if err != nil {
+		return CorsPolicy{}, err
+	}
+	policy := CorsPolicy{
+		AllowedOrigins:   listFromEnv("CORS_ALLOWED_ORIGINS", "*"),
+		AllowedMethods:   listFromEnv("CORS_ALLOWED_METHODS", "GET, POST, PUT, DELETE"),
+		AllowedHeaders:   listFromEnv("CORS_ALLOWED_HEADERS", "Authorization, Content-Type"),
+		AllowCredentials: os.Getenv("CORS_ALLOW_CREDENTIALS") == "true",
+		MaxAge:           maxAge,
+	}
+	if policy.AllowCredentials && contains(policy.AllowedOrigins, "*") {
+		return CorsPolicy{}, fmt.Errorf("CORS_ALLOWED_ORIGINS must list the origins when CORS_ALLOW_CREDENTIALS is true, not \"*\".")
+	}
+	return policy, nil
+}
+
+func listFromEnv(name string, fallback string) []string {
+	value := os.Getenv(name)
+	if value == "" {
+		value = fallback
+	}
+	return splitList(value)
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (self CorsPolicy) Middleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		allowedOrigin := self.allowedOrigin(request.Header.Get("Origin"))
+		writer.Header().Add("Vary", "Origin")
+		if allowedOrigin != "" {
+			writer.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
+			if self.AllowCredentials {
+				writer.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		handler.ServeHTTP(writer, request)
+		if request.Method != "OPTIONS" || allowedOrigin == "" {
+			return
+		}
+		header := writer.Header()
+		if methods := self.allowed(self.AllowedMethods, header.Get("Allow")); len(methods) > 0 {
+			header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		}
+		if headers := self.allowed(self.AllowedHeaders, request.Header.Get("Access-Control-Request-Headers")); len(headers) > 0 {
+			header.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		}
+		if self.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(self.MaxAge.Seconds())))
+		}
+	})
+}
+
+func (self CorsPolicy) allowedOrigin(origin string) string {
+	for _, allowed := range self.AllowedOrigins {
+		switch {
+		case allowed == "*":
+			return "*"
+		case origin != "" && strings.EqualFold(allowed, origin):
+			return origin
+		}
+	}
+	return ""
+}
+
+func (self CorsPolicy) allowed(allowed []string, requested string) []string {
+	var result []string
+	for _, item := range splitList(requested) {
+		for _, candidate := range allowed {
+			if candidate == "*" || strings.EqualFold(candidate, item) {
+				result = append(result, item)
+				break
+			}
+		}
+	}
+	return result
+}
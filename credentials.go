@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+var DeviceUnauthorizedError = NewUnauthorizedError("Requests for a device must send its key as a Bearer token.")
+var DeviceForbiddenError = NewForbiddenError("The key sent is not valid for this device.")
+var LegacyDeviceKeyError = NewForbiddenError("This device was registered before keys existed. An operator must issue its key.")
+
+type DeviceCredentials struct {
+	DeviceId string
+	Key      string
+}
+
+func newKey() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func keyMatches(keyHash string, key string) bool {
+	if keyHash == "" || key == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashKey(key)), []byte(keyHash)) == 1
+}
+
+func (self DeviceDocument) HasKey(key string) bool {
+	return keyMatches(self.KeyHash, key)
+}
+
+type KeyHolder interface {
+	HasKey(key string) bool
+}
+
+func (self *SidewinderDirector) Authenticated(handler DeviceHandler) DeviceHandler {
+	return func(deviceId string, writer http.ResponseWriter, request *http.Request) error {
+		device, err := self.StoreWith(request.Context()).FindDevice(deviceId)
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+		if refused, err := refuseUnauthorized(device, DeviceUnauthorizedError, DeviceForbiddenError, writer, request); refused {
+			return self.failedAuth(err, writer, request)
+		}
+		return handler(deviceId, writer, request)
+	}
+}
+
+func (self *SidewinderDirector) failedAuth(err error, writer http.ResponseWriter, request *http.Request) error {
+	if allowed, wait := self.failedAuths.Take(clientIp(request)); !allowed {
+		setRetryAfter(writer, wait)
+		return RateLimitedError
+	}
+	return err
+}
+
+func refuseUnauthorized(holder KeyHolder, unauthorized, forbidden *ApiError, writer http.ResponseWriter, request *http.Request) (bool, error) {
+	key := bearerToken(request)
+	if key == "" {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		return true, unauthorized
+	} else if !holder.HasKey(key) {
+		return true, forbidden
+	}
+	return false, nil
+}
+
+func (self *SidewinderDirector) issueDeviceKey(deviceId string) (*DeviceCredentials, error) {
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	store := self.Store()
+	defer store.Close()
+	if err := store.SetDeviceKeyHash(deviceId, hashKey(key)); err != nil {
+		return nil, err
+	}
+	return &DeviceCredentials{deviceId, key}, nil
+}
+
+func (self *SidewinderDirector) claimLegacyDeviceKey(deviceId string) (*DeviceCredentials, error) {
+	if !time.Now().Before(self.LegacyKeyClaimsUntil) {
+		return nil, LegacyDeviceKeyError
+	}
+
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	store := self.Store()
+	defer store.Close()
+	claimed, err := store.ClaimDeviceKey(deviceId, hashKey(key))
+	if err != nil {
+		return nil, err
+	} else if !claimed {
+		return nil, DeviceForbiddenError
+	}
+	Log.Warn("Issued a key to a device registered before keys existed.", LogFields{"device_id": deviceId})
+	return &DeviceCredentials{deviceId, key}, nil
+}
+
+func (self *SidewinderDirector) RotateDeviceKey(deviceId string, writer http.ResponseWriter, request *http.Request) error {
+	credentials, err := self.issueDeviceKey(deviceId)
+	if err != nil {
+		return err
+	}
+	return writeJson(200, credentials, writer, request)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/anachronistic/apns"
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	DryRunKey   = "dryRun"
+	ProviderKey = "provider"
+)
+
+const (
+	RuleUnfinished              = "unfinished"
+	RuleFailure                 = "failure"
+	RuleFailureEarlierInCommit  = "failure-earlier-in-commit"
+	RuleFailureInPreviousCommit = "failure-in-previous-commit"
+	RuleFailureInPreviousBuild  = "failure-in-previous-build"
+	RuleNoRecentFailure         = "no-recent-failure"
+)
+
+var ruleReasons = map[string]string{
+	RuleUnfinished:              "Build is not finished.",
+	RuleFailure:                 "Build failed.",
+	RuleFailureEarlierInCommit:  "First success after a failure earlier in this commit.",
+	RuleFailureInPreviousCommit: "First success after a failure in the previous commit.",
+	RuleFailureInPreviousBuild:  "First success after a failure in the previous build.",
+	RuleNoRecentFailure:         "Build succeeded without a recent failure.",
+}
+
+type NotificationDecision struct {
+	Event         BuildEvent
+	Statuses      map[string][]GithubStatus `json:",omitempty"`
+	PreviousState string                    `json:",omitempty"`
+	Rule          string
+	Reason        string
+	Notify        bool
+	Devices       []string
+	Payload       *apns.Payload
+	commit        string
+	ctx           context.Context
+}
+
+func (self *NotificationDecision) recordStatuses(url string, statuses []GithubStatus) {
+	if self.Statuses == nil {
+		self.Statuses = make(map[string][]GithubStatus)
+	}
+	self.Statuses[url] = statuses
+}
+
+func (self *NotificationDecision) decide(recoveryRule string) {
+	switch {
+	case !self.Event.IsFinished():
+		self.Rule = RuleUnfinished
+	case self.Event.IsFailure():
+		self.Notify, self.Rule = true, RuleFailure
+	case recoveryRule != "":
+		self.Notify, self.Rule = true, recoveryRule
+	default:
+		self.Rule = RuleNoRecentFailure
+	}
+	self.Reason = ruleReasons[self.Rule]
+}
+
+func (self *SidewinderDirector) target(decision *NotificationDecision) error {
+	if !decision.Notify {
+		return nil
+	}
+
+	repositories, err := self.StoreWith(decision.ctx).MatchingRepositories(decision.Event.SubscriptionName())
+	if err != nil {
+		return err
+	}
+	var subscriptions RepositoryDocument
+	for _, repository := range repositories {
+		subscriptions.DeviceList = append(subscriptions.DeviceList, repository.DeviceList...)
+		subscriptions.UserList = append(subscriptions.UserList, repository.UserList...)
+		subscriptions.AuthorDeviceList = append(subscriptions.AuthorDeviceList, repository.AuthorDeviceList...)
+		subscriptions.AuthorUserList = append(subscriptions.AuthorUserList, repository.AuthorUserList...)
+	}
+	if decision.commit != "" && len(subscriptions.AuthorDeviceList)+len(subscriptions.AuthorUserList) > 0 {
+		self.addPullRequestParticipants(decision)
+	}
+	if decision.Devices, err = self.StoreWith(decision.ctx).SubscribedDevices(&subscriptions, decision.Event.Authors); err != nil {
+		return err
+	}
+
+	decision.Payload = apns.NewPayload()
+	decision.Payload.Alert = decision.Event.Alert()
+	return nil
+}
+
+func (self *SidewinderDirector) addPullRequestParticipants(decision *NotificationDecision) {
+	participants, err := self.pullRequestParticipants(decision.Event.Repository, decision.commit, decision)
+	if err != nil {
+		Log.Warn("Could not look up the pull requests of a commit.", LogFields{
+			"repository": decision.Event.Repository,
+			"commit":     decision.commit,
+			"error":      err.Error(),
+		})
+		return
+	}
+	for _, participant := range participants {
+		if !contains(decision.Event.Authors, participant) {
+			decision.Event.Authors = append(decision.Event.Authors, participant)
+		}
+	}
+}
+
+func (self *SidewinderDirector) deliver(context web.C, writer http.ResponseWriter, request *http.Request, decision *NotificationDecision) error {
+	if isDryRun(context) {
+		return writeJson(200, decision, writer, request)
+	}
+
+	annotate(context, "repository", decision.Event.SubscriptionName())
+	countWebhookEvent(webhookProvider(context), decision.Event.State)
+
+	if decision.Notify {
+		for _, deviceId := range decision.Devices {
+			if payload := self.throttledPayload(deviceId, decision); payload != nil {
+				self.push(decision.ctx, deviceId, payload)
+			}
+		}
+	}
+
+	return writeJson(200, Accepted, writer, request)
+}
+
+func (self *SidewinderDirector) throttledPayload(deviceId string, decision *NotificationDecision) *apns.Payload {
+	if self.PushLimit <= 0 {
+		return decision.Payload
+	}
+
+	allowed, suppressed, err := self.StoreWith(decision.ctx).TakePush(deviceId, decision.Event.SubscriptionName(), self.PushLimit, self.PushWindow)
+	if err != nil {
+		Log.Error("Could not throttle push.", err, LogFields{
+			"device_id":  deviceId,
+			"repository": decision.Event.SubscriptionName()})
+		return decision.Payload
+	} else if !allowed {
+		pushDeliveries.WithLabelValues("throttled").Inc()
+		return nil
+	} else if suppressed == 0 {
+		return decision.Payload
+	}
+
+	payload := *decision.Payload
+	payload.Alert = fmt.Sprintf("%v (and %v more notifications)", decision.Payload.Alert, suppressed)
+	return &payload
+}
+
+func DryRun(handler RestHandler) RestHandler {
+	return func(context web.C, writer http.ResponseWriter, request *http.Request) error {
+		return handler(withEnv(context, DryRunKey, true), writer, request)
+	}
+}
+
+func withEnv(context web.C, key string, value interface{}) web.C {
+	env := make(map[interface{}]interface{}, len(context.Env)+1)
+	for existingKey, existingValue := range context.Env {
+		env[existingKey] = existingValue
+	}
+	env[key] = value
+	context.Env = env
+	return context
+}
+
+func isDryRun(context web.C) bool {
+	dryRun, _ := context.Env[DryRunKey].(bool)
+	return dryRun
+}
+
+func webhookProvider(context web.C) string {
+	provider, _ := context.Env[ProviderKey].(string)
+	return provider
+}
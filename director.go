@@ -1,38 +1,214 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/anachronistic/apns"
 	"github.com/zenazn/goji/web"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"gopkg.in/mgo.v2"
 )
 
-var AddDeviceMissingDeviceIdError = ErrorJson{"POST to /devices must be a JSON with a DeviceId property."}
+var AddDeviceMissingDeviceIdError = NewValidationError("POST to /devices must be a JSON with a DeviceId property.")
+var GithubMissingBranchError = NewValidationError("Did not recieve a valid branch in Github status.")
+var NotificationInvalidError = NewValidationError("POST to /devices/:id/notifications must be a JSON with an Alert.")
+var SubscriptionInvalidError = NewValidationError("A subscription must be a JSON with a valid Name and an optional Mode.")
+
+const (
+	DeviceRegistrationsPerMinute = 30
+	DeviceNotificationsPerMinute = 10
+	FailedAuthsPerMinute         = 20
+)
+
+const (
+	SubscriptionAll  = "all"
+	SubscriptionMine = "mine"
+)
 
 type SidewinderDirector struct {
-	MongoDB          string
-	session          *mgo.Session
-	ApnsCommunicator *APNSCommunicator
-	ApiCommunicator  ApiCommunicator
+	MongoDB              string
+	session              *mgo.Session
+	ApnsCommunicator     *APNSCommunicator
+	ApiCommunicator      ApiCommunicator
+	GitlabToken          string
+	BitbucketSecret      string
+	GenericToken         string
+	AdminToken           string
+	Github               GithubConfig
+	Cors                 CorsPolicy
+	Tls                  TlsConfig
+	DeliveryTTL          time.Duration
+	WebhookMaxAge        time.Duration
+	PushLimit            int
+	PushWindow           time.Duration
+	ShutdownTimeout      time.Duration
+	ReadyTimeout         time.Duration
+	ReadyMaxPushes       int
+	TeamRefreshInterval  time.Duration
+	LegacySunset         time.Time
+	LegacyKeyClaimsUntil time.Time
+	TracePropagation     []string
+	pushes               sync.WaitGroup
+	pushesInFlight       int32
+	webhooks             map[string]RestHandler
+	failedAuths          *RateLimiter
+	tracerProvider       *sdktrace.TracerProvider
 }
 
 func NewSidewinderDirector(mongoDB string, apnsCommunicator *APNSCommunicator, apiCommunicator ApiCommunicator) (*SidewinderDirector, error) {
+	deliveryTTL, err := durationFromEnv("DELIVERY_TTL", 72*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	webhookMaxAge, err := durationFromEnv("WEBHOOK_MAX_AGE", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	cors, err := CorsPolicyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := TlsConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	pushLimit, err := intFromEnv("PUSH_LIMIT", 5)
+	if err != nil {
+		return nil, err
+	}
+	pushWindow, err := durationFromEnv("PUSH_WINDOW", 10*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	shutdownTimeout, err := durationFromEnv("SHUTDOWN_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	logLevel, err := levelFromEnv("LOG_LEVEL", LevelInfo)
+	if err != nil {
+		return nil, err
+	}
+	Log.Level = logLevel
+
+	readyTimeout, err := durationFromEnv("READY_TIMEOUT", 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	readyMaxPushes, err := intFromEnv("READY_MAX_PUSHES", 100)
+	if err != nil {
+		return nil, err
+	}
+
+	teamRefreshInterval, err := durationFromEnv("TEAM_REFRESH_INTERVAL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	legacySunset, err := dateFromEnv("LEGACY_API_SUNSET", LegacyDeprecatedAt.AddDate(0, 6, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	legacyKeyClaimsUntil, err := dateFromEnv("LEGACY_KEY_CLAIMS_UNTIL", time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	github, err := GithubConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	tracerProvider, err := TracingFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
 	session, err := mgo.Dial("mongo,localhost")
 	if err != nil {
 		return nil, err
 	}
-	return &SidewinderDirector{mongoDB, session, apnsCommunicator, apiCommunicator}, nil
+
+	director := &SidewinderDirector{
+		MongoDB:              mongoDB,
+		session:              session,
+		ApnsCommunicator:     apnsCommunicator,
+		ApiCommunicator:      InstrumentedApiCommunicator{apiCommunicator},
+		GitlabToken:          os.Getenv("GITLAB_TOKEN"),
+		BitbucketSecret:      os.Getenv("BITBUCKET_SECRET"),
+		GenericToken:         os.Getenv("GENERIC_WEBHOOK_TOKEN"),
+		AdminToken:           os.Getenv("ADMIN_TOKEN"),
+		Github:               github,
+		Cors:                 cors,
+		Tls:                  tlsConfig,
+		DeliveryTTL:          deliveryTTL,
+		WebhookMaxAge:        webhookMaxAge,
+		PushLimit:            pushLimit,
+		PushWindow:           pushWindow,
+		ShutdownTimeout:      shutdownTimeout,
+		ReadyTimeout:         readyTimeout,
+		ReadyMaxPushes:       readyMaxPushes,
+		TeamRefreshInterval:  teamRefreshInterval,
+		LegacySunset:         legacySunset,
+		LegacyKeyClaimsUntil: legacyKeyClaimsUntil,
+		TracePropagation:     listFromEnv("TRACE_PROPAGATION_HOSTS", ""),
+		webhooks:             make(map[string]RestHandler),
+		failedAuths:          NewRateLimiter(FailedAuthsPerMinute, time.Minute, ByClient),
+		tracerProvider:       tracerProvider,
+	}
+	store := director.Store()
+	defer store.Close()
+	if err := store.EnsureDeliveryIndex(deliveryTTL); err != nil {
+		return nil, err
+	}
+	if err := store.EnsureWebhookArchive(WebhookArchiveBytes); err != nil {
+		return nil, err
+	}
+	if err := store.EnsureOAuthStateIndex(OAuthStateTTL); err != nil {
+		return nil, err
+	}
+	if err := store.EnsureThrottleIndex(throttleTTL(pushWindow)); err != nil {
+		return nil, err
+	}
+	return director, nil
 }
 
 func (self *SidewinderDirector) Store() *SidewinderStore {
-	return &SidewinderStore{self.MongoDB, self.session.Copy()}
+	return &SidewinderStore{self.MongoDB, self.session.Copy(), nil}
+}
+
+// StoreWith uses the session the Sessions middleware copied for the request,
+// which is closed when the request ends, or the master session otherwise.
+func (self *SidewinderDirector) StoreWith(ctx context.Context) *SidewinderStore {
+	if ctx != nil {
+		if session, ok := ctx.Value(sessionContextKey{}).(*mgo.Session); ok {
+			return &SidewinderStore{self.MongoDB, session, ctx}
+		}
+	}
+	return &SidewinderStore{self.MongoDB, self.session, ctx}
+}
+
+type sessionContextKey struct{}
+
+func (self *SidewinderDirector) Sessions(c *web.C, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		session := self.session.Copy()
+		defer session.Close()
+		handler.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), sessionContextKey{}, session)))
+	})
 }
 
 func (self *SidewinderDirector) DatastoreInfo(context web.C, writer http.ResponseWriter, request *http.Request) error {
-	session := self.Store().session
+	session := self.StoreWith(request.Context()).session
 
 	buildInfo, err := session.BuildInfo()
 	if err != nil {
@@ -51,82 +227,162 @@ func (self *SidewinderDirector) DatastoreInfo(context web.C, writer http.Respons
 }
 
 func (self *SidewinderDirector) postDevice(context web.C, writer http.ResponseWriter, request *http.Request) error {
-	sentJSON := decodeDeviceDocument(request)
-	if sentJSON == nil {
-		return writeJson(400, AddDeviceMissingDeviceIdError, writer)
+	var sentJSON DeviceDocument
+	violations, err := decodeJson(request, &sentJSON)
+	if err != nil {
+		return err
+	}
+	violations.Check(isDeviceToken(sentJSON.DeviceId), "DeviceId must be an APNS device token of 64 hexadecimal characters.")
+	if err := violations.Refusal(AddDeviceMissingDeviceIdError); err != nil {
+		return err
 	}
-	recordWasCreated, err := self.Store().AddDevice(sentJSON.DeviceId)
+
+	key, err := newKey()
 	if err != nil {
 		return err
-	} else {
-		return writeJson(insertCode(recordWasCreated), sentJSON, writer)
 	}
-}
+	recordWasCreated, err := self.StoreWith(request.Context()).AddDevice(sentJSON.DeviceId, hashKey(key))
+	if err != nil {
+		return err
+	} else if recordWasCreated {
+		return writeJson(201, DeviceCredentials{sentJSON.DeviceId, key}, writer, request)
+	}
 
-func decodeDeviceDocument(request *http.Request) *DeviceDocument {
-	var sentJSON DeviceDocument
-	if decodeErr := json.NewDecoder(request.Body).Decode(&sentJSON); decodeErr == nil && sentJSON.DeviceId != "" {
-		return &sentJSON
-	} else {
-		return nil
+	device, err := self.StoreWith(request.Context()).FindDevice(sentJSON.DeviceId)
+	if err != nil {
+		return err
+	} else if device.KeyHash == "" {
+		credentials, err := self.claimLegacyDeviceKey(device.DeviceId)
+		if err != nil {
+			return err
+		}
+		return writeJson(200, credentials, writer, request)
+	}
+
+	if refused, err := refuseUnauthorized(device, DeviceUnauthorizedError, DeviceForbiddenError, writer, request); refused {
+		return err
 	}
+	return writeJson(200, device, writer, request)
 }
 
 type DeviceHandler func(id string, writer http.ResponseWriter, request *http.Request) error
 
 func (self DeviceHandler) ServeHTTPC(context web.C, writer http.ResponseWriter, request *http.Request) {
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
 	deviceId := context.URLParams["id"]
 	err := self(deviceId, writer, request)
 	if err != nil {
-		writeJson(500, ErrorJson{err.Error()}, writer)
+		failRequest(context, writer, request, err)
 	}
 }
 
 func (self *SidewinderDirector) deleteDevice(deviceId string, writer http.ResponseWriter, request *http.Request) error {
-	result, err := self.Store().FindDevice(deviceId)
+	result, err := self.StoreWith(request.Context()).FindDevice(deviceId)
 	if err != nil {
 		return err
 	}
 
-	if err := self.Store().DeleteDevice(deviceId); err != nil {
+	if err := self.StoreWith(request.Context()).DeleteDevice(deviceId); err != nil {
 		return err
 	}
 
-	return writeJson(200, result, writer)
+	return writeJson(200, result, writer, request)
 }
 
 func (self *SidewinderDirector) DeviceMux() *RestEndpoint {
 	return (&RestEndpoint{
-		Delete: DeviceHandler(self.deleteDevice),
+		Delete: self.Authenticated(self.deleteDevice),
+		Docs: map[string]Operation{
+			"DELETE": {Summary: "Unregister a device.", Response: DeviceDocument{}},
+		},
 	}).Route("/repositories", RestEndpoint{
-		Get:  DeviceHandler(self.GetRepositories),
-		Post: DeviceHandler(self.AddRepository),
+		Get:  self.Authenticated(self.GetRepositories),
+		Post: self.Authenticated(self.AddRepository),
+		Docs: map[string]Operation{
+			"GET":  {Summary: "List the subscriptions of a device.", Response: []RepositoryDocument{}},
+			"POST": {Summary: "Subscribe a device.", Status: 201, Request: SubscriptionMessage{}, Response: SubscriptionMessage{}},
+		},
 	}).Route("/notifications", RestEndpoint{
-		Post: DeviceHandler(self.PostNotification),
+		Post: self.Authenticated(NewRateLimiter(DeviceNotificationsPerMinute, time.Minute, nil).LimitDevice(self.PostNotification)),
+		Docs: map[string]Operation{
+			"POST": {Summary: "Push a notification to a device.", Status: 201, Request: NotificationMessage{}, Response: NotificationMessage{}},
+		},
+	}).Route("/credentials", RestEndpoint{
+		Post: self.Authenticated(self.RotateDeviceKey),
+		Docs: map[string]Operation{
+			"POST": {Summary: "Issue a new device key.", Response: DeviceCredentials{}},
+		},
 	})
 }
 
 func (self *SidewinderDirector) GetRepositories(deviceId string, writer http.ResponseWriter, request *http.Request) error {
-	repositories, err := self.Store().RepositoriesForDevice(deviceId)
+	repositories, err := self.StoreWith(request.Context()).RepositoriesForDevice(deviceId)
+	if err != nil {
+		return err
+	}
+
+	device, err := self.StoreWith(request.Context()).FindDevice(deviceId)
+	if err != nil {
+		return err
+	} else if device.UserId != "" {
+		userRepositories, err := self.StoreWith(request.Context()).RepositoriesForUser(device.UserId)
+		if err != nil {
+			return err
+		}
+		for _, repository := range userRepositories {
+			repository.Via = "user"
+			repositories = append(repositories, repository)
+		}
+	}
+	return writeJson(200, repositories, writer, request)
+}
+
+type NotificationMessage struct {
+	Alert string
+}
 
-	if err == nil {
-		writeJson(200, repositories, writer)
+type SubscriptionMessage struct {
+	Name string
+	Mode string `json:",omitempty"`
+}
+
+func (self SubscriptionMessage) HasValidMode() bool {
+	return self.Mode == "" || self.Mode == SubscriptionAll || self.Mode == SubscriptionMine
+}
+
+func decodeSubscription(request *http.Request) (SubscriptionMessage, error) {
+	var message SubscriptionMessage
+	violations, err := decodeJson(request, &message)
+	if err != nil {
+		return message, err
 	}
-	return err
+	violations.Check(isValidRepositoryName(message.Name), "Name must be owner/name, owner/*, @org/team or source:name.")
+	violations.Check(message.HasValidMode(), "Mode must be \"all\" or \"mine\".")
+	return message, violations.Refusal(SubscriptionInvalidError)
 }
 
 func (self *SidewinderDirector) AddRepository(deviceId string, writer http.ResponseWriter, request *http.Request) error {
-	var repositoryMessage struct{ Name string }
-	if decodeErr := json.NewDecoder(request.Body).Decode(&repositoryMessage); decodeErr != nil {
-		return decodeErr
+	repositoryMessage, err := decodeSubscription(request)
+	if err != nil {
+		return err
+	}
+
+	device, err := self.StoreWith(request.Context()).FindDevice(deviceId)
+	if err != nil {
+		return err
 	}
-	wasInserted, err := self.Store().AddDeviceToRepository(deviceId, repositoryMessage.Name)
+	if err := self.refuseMode(request.Context(), device.UserId, repositoryMessage.Mode); err != nil {
+		return err
+	}
+	if refused, err := self.refuseSubscription(request.Context(), device.UserId, repositoryMessage.Name); refused {
+		return err
+	}
+
+	wasInserted, err := self.StoreWith(request.Context()).AddDeviceToRepository(deviceId, repositoryMessage.Name, repositoryMessage.Mode)
 	if err != nil {
 		return err
 	}
 
-	return writeJson(insertCode(wasInserted), repositoryMessage, writer)
+	return writeJson(insertCode(wasInserted), repositoryMessage, writer, request)
 }
 
 func insertCode(wasInserted bool) int {
@@ -138,27 +394,43 @@ func insertCode(wasInserted bool) int {
 }
 
 func (self *SidewinderDirector) PostNotification(deviceId string, writer http.ResponseWriter, request *http.Request) error {
-	var notification map[string]string
-	if decodeErr := json.NewDecoder(request.Body).Decode(&notification); decodeErr != nil {
-		return decodeErr
+	var notification NotificationMessage
+	violations, err := decodeJson(request, &notification)
+	if err != nil {
+		return err
 	}
+	violations.Check(notification.Alert != "", "Alert is required.")
+	if err := violations.Refusal(NotificationInvalidError); err != nil {
+		return err
+	}
+
 	payload := apns.NewPayload()
-	payload.Alert = notification["Alert"]
+	payload.Alert = notification.Alert
 
-	if err := self.ApnsCommunicator.sendPushNotification(deviceId, payload); err != nil {
+	if err := self.push(request.Context(), deviceId, payload); err != nil {
 		return err
 	}
-	return writeJson(201, notification, writer)
+	return writeJson(201, notification, writer, request)
 }
 
 type GithubStatus struct {
 	Name        string
+	Sha         string
 	Context     string
 	State       string
 	Description string
 	Branches    []struct {
 		Name string
 	}
+	UpdatedAt time.Time `json:"updated_at"`
+	Commit    struct {
+		Author    GithubAccount
+		Committer GithubAccount
+	}
+}
+
+type GithubAccount struct {
+	Login string
 }
 
 func (self *SidewinderDirector) GithubNotify(context web.C, writer http.ResponseWriter, request *http.Request) error {
@@ -166,49 +438,164 @@ func (self *SidewinderDirector) GithubNotify(context web.C, writer http.Response
 	if decodeErr := json.NewDecoder(request.Body).Decode(&notification); decodeErr != nil {
 		return decodeErr
 	}
-
-	repository, err := self.Store().FindRepository(notification.Name)
-	if err != nil {
-		return err
+	if !isDryRun(context) && self.isStale(notification.UpdatedAt) {
+		return WebhookStaleDeliveryError
 	}
 	if len(notification.Branches) < 1 {
-		return writeJson(400, ErrorJson{"Did not recieve a valid branch in Github status."}, writer)
+		return GithubMissingBranchError
 	}
 
 	branch := notification.Branches[0]
-	shouldNotify, err := self.IsFirstSuccessAfterFailure(notification, branch.Name)
+	decision := &NotificationDecision{Event: notification.BuildEvent(branch.Name), commit: notification.Sha, ctx: traceContext(context)}
+	recoveryRule, err := self.IsFirstSuccessAfterFailure(notification, branch.Name, decision)
 	if err != nil {
 		return err
 	}
 
-	if notification.State == "failure" || notification.State == "error" || shouldNotify {
-		payload := apns.NewPayload()
-		payload.Alert = notification.Name + ": " + notification.Description
-		for _, deviceId := range repository.DeviceList {
-			self.ApnsCommunicator.sendPushNotification(deviceId, payload)
+	decision.decide(recoveryRule)
+	if err := self.target(decision); err != nil {
+		return err
+	}
+	return self.deliver(context, writer, request, decision)
+}
+
+func (self GithubStatus) BuildEvent(branch string) BuildEvent {
+	return BuildEvent{
+		Repository:  self.Name,
+		Branch:      branch,
+		Context:     self.Context,
+		State:       self.State,
+		Description: self.Description,
+		Authors:     self.Authors(),
+	}
+}
+
+func (self GithubStatus) Authors() []string {
+	var authors []string
+	for _, account := range []GithubAccount{self.Commit.Author, self.Commit.Committer} {
+		if account.Login != "" && !contains(authors, account.Login) {
+			authors = append(authors, account.Login)
 		}
 	}
+	return authors
+}
+
+type BuildEvent struct {
+	Provider    string   `json:"-"`
+	Repository  string   `json:"repository"`
+	Branch      string   `json:"branch"`
+	Context     string   `json:"context"`
+	State       string   `json:"state"`
+	Description string   `json:"description"`
+	Url         string   `json:"url"`
+	Authors     []string `json:"authors,omitempty"`
+}
+
+func (self BuildEvent) SubscriptionName() string {
+	if self.Provider == "" {
+		return self.Repository
+	}
+	return self.Provider + ":" + self.Repository
+}
+
+func (self BuildEvent) IsFailure() bool {
+	return isFailureState(self.State)
+}
+
+func (self BuildEvent) IsFinished() bool {
+	return self.State == "success" || self.IsFailure()
+}
+
+func (self BuildEvent) Alert() string {
+	return self.Repository + ": " + self.Description
+}
+
+func isFailureState(state string) bool {
+	return state == "failure" || state == "error"
+}
 
-	fmt.Fprintf(writer, "Accepted.")
-	return nil
+func (self *SidewinderDirector) NotifyBuildEvent(context web.C, writer http.ResponseWriter, request *http.Request, event BuildEvent) error {
+	decision, err := self.DecideBuildEvent(traceContext(context), event, isDryRun(context))
+	if err != nil {
+		return err
+	}
+	return self.deliver(context, writer, request, decision)
 }
 
-func (self *SidewinderDirector) getStatusesForCommit(name string, commit string) ([]GithubStatus, error) {
-	url := fmt.Sprintf("https://api.github.com/repos/%v/commits/%v/statuses", name, commit)
-	response, err := self.ApiCommunicator.Get(url)
+func (self *SidewinderDirector) DecideBuildEvent(ctx context.Context, event BuildEvent, dryRun bool) (*NotificationDecision, error) {
+	decision := &NotificationDecision{Event: event, ctx: ctx}
+	if !event.IsFinished() {
+		decision.decide("")
+		return decision, nil
+	}
+
+	previousState, err := self.previousBuildState(ctx, event, dryRun)
 	if err != nil {
 		return nil, err
 	}
 
+	decision.PreviousState = previousState
+	if isFailureState(previousState) {
+		decision.decide(RuleFailureInPreviousBuild)
+	} else {
+		decision.decide("")
+	}
+	return decision, self.target(decision)
+}
+
+func (self *SidewinderDirector) previousBuildState(ctx context.Context, event BuildEvent, dryRun bool) (string, error) {
+	if dryRun {
+		return self.StoreWith(ctx).FindBuildState(event.SubscriptionName(), event.Branch, event.Context)
+	}
+	return self.StoreWith(ctx).RecordBuildState(event.SubscriptionName(), event.Branch, event.Context, event.State)
+}
+
+func (self *SidewinderDirector) getStatusesForCommit(name string, commit string, decision *NotificationDecision) ([]GithubStatus, error) {
+	path := fmt.Sprintf("/repos/%v/commits/%v/statuses", name, commit)
+	response, err := self.githubGet(decision.ctx, path)
+	if err != nil {
+		return nil, githubError(err)
+	}
+	defer response.Body.Close()
+
 	var statuses []GithubStatus
 	if decodeErr := json.NewDecoder(response.Body).Decode(&statuses); decodeErr != nil {
-		return nil, decodeErr
+		return nil, githubError(decodeErr)
 	}
+	decision.recordStatuses(self.Github.ApiUrl+path, statuses)
 	return statuses, nil
 }
 
-func (self *SidewinderDirector) hasAPreviousFailureInThisCommit(status GithubStatus, branch string) (bool, error) {
-	statuses, err := self.getStatusesForCommit(status.Name, branch)
+func (self *SidewinderDirector) pullRequestParticipants(name string, commit string, decision *NotificationDecision) ([]string, error) {
+	response, err := self.githubGet(decision.ctx, fmt.Sprintf("/repos/%v/commits/%v/pulls", name, commit))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var pulls []struct {
+		User               GithubAccount
+		Assignees          []GithubAccount
+		RequestedReviewers []GithubAccount `json:"requested_reviewers"`
+	}
+	if decodeErr := json.NewDecoder(response.Body).Decode(&pulls); decodeErr != nil {
+		return nil, decodeErr
+	}
+
+	var participants []string
+	for _, pull := range pulls {
+		accounts := append([]GithubAccount{pull.User}, pull.Assignees...)
+		for _, account := range append(accounts, pull.RequestedReviewers...) {
+			if account.Login != "" && !contains(participants, account.Login) {
+				participants = append(participants, account.Login)
+			}
+		}
+	}
+	return participants, nil
+}
+
+func (self *SidewinderDirector) hasAPreviousFailureInThisCommit(status GithubStatus, branch string, decision *NotificationDecision) (bool, error) {
+	statuses, err := self.getStatusesForCommit(status.Name, branch, decision)
 	if err != nil {
 		return false, err
 	}
@@ -234,9 +621,9 @@ func (self *SidewinderDirector) hasAPreviousFailureInThisCommit(status GithubSta
 	return false, nil
 }
 
-func (self *SidewinderDirector) hasFailuresInPreviousCommit(status GithubStatus, branch string) (bool, error) {
+func (self *SidewinderDirector) hasFailuresInPreviousCommit(status GithubStatus, branch string, decision *NotificationDecision) (bool, error) {
 	previousCommit := branch + "^"
-	statuses, err := self.getStatusesForCommit(status.Name, previousCommit)
+	statuses, err := self.getStatusesForCommit(status.Name, previousCommit, decision)
 	if err != nil {
 		return false, err
 	}
@@ -254,17 +641,24 @@ func (self *SidewinderDirector) hasFailuresInPreviousCommit(status GithubStatus,
 	return false, nil
 }
 
-func (self *SidewinderDirector) IsFirstSuccessAfterFailure(status GithubStatus, branch string) (bool, error) {
+func (self *SidewinderDirector) IsFirstSuccessAfterFailure(status GithubStatus, branch string, decision *NotificationDecision) (string, error) {
 	if status.State != "success" {
-		return false, nil
+		return "", nil
 	}
 
-	previousFailure, err := self.hasAPreviousFailureInThisCommit(status, branch)
+	previousFailure, err := self.hasAPreviousFailureInThisCommit(status, branch, decision)
 	if err != nil {
-		return false, err
+		return "", err
 	} else if previousFailure {
-		return true, nil
+		return RuleFailureEarlierInCommit, nil
+	}
+
+	previousCommitFailure, err := self.hasFailuresInPreviousCommit(status, branch, decision)
+	if err != nil {
+		return "", err
+	} else if previousCommitFailure {
+		return RuleFailureInPreviousCommit, nil
 	} else {
-		return self.hasFailuresInPreviousCommit(status, branch)
+		return "", nil
 	}
 }
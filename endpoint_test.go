@@ -2,24 +2,40 @@ package main_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/anachronistic/apns"
 	server "github.com/sidewinder-team/sidewinder-server"
 	"github.com/zenazn/goji"
 	"github.com/zenazn/goji/web"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
 const (
-	TestDatabaseName = "SidewinderTest"
+	TestDatabaseName    = "SidewinderTest"
+	TestGitlabToken     = "frobozz"
+	TestBitbucketSecret = "klaatu"
+	TestGenericToken    = "heuristic"
+	TestAdminToken      = "xyzzy"
+	TestGithubTokenKey  = "62652d657863656c6c656e742d746f2d656163682d6f746865722d6475646573"
 )
 
 func NewPOSTRequestWithJSON(path string, body interface{}) (*http.Request, []byte) {
@@ -34,15 +50,95 @@ func NewPOSTRequestWithJSON(path string, body interface{}) (*http.Request, []byt
 
 	request, err := http.NewRequest("POST", path, bytes.NewReader(data))
 	Expect(err).NotTo(HaveOccurred())
+	request.Header.Set("Content-Type", "application/json")
 	return request, data
 }
 
+func deviceToken(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
 func NewRequest(method string, path string) *http.Request {
 	request, err := http.NewRequest(method, path, nil)
 	Expect(err).NotTo(HaveOccurred())
 	return request
 }
 
+func checkSchema(document map[string]interface{}, schema map[string]interface{}, value interface{}, at string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		schemas := document["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+		return checkSchema(document, schemas[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]interface{}), value, at)
+	} else if value == nil {
+		return nil
+	}
+
+	valid := true
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%v is not an object.", at)
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		for key, field := range object {
+			fieldSchema, known := properties[key].(map[string]interface{})
+			if !known {
+				fieldSchema, known = schema["additionalProperties"].(map[string]interface{})
+			}
+			if !known {
+				return fmt.Errorf("%v.%v is not in the schema.", at, key)
+			} else if err := checkSchema(document, fieldSchema, field, at+"."+key); err != nil {
+				return err
+			}
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%v is not an array.", at)
+		}
+		for i, item := range items {
+			if err := checkSchema(document, schema["items"].(map[string]interface{}), item, fmt.Sprintf("%v[%v]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		_, valid = value.(string)
+	case "integer":
+		number, ok := value.(float64)
+		valid = ok && number == float64(int64(number))
+	case "number":
+		_, valid = value.(float64)
+	case "boolean":
+		_, valid = value.(bool)
+	}
+	if !valid {
+		return fmt.Errorf("%v is not a %v.", at, schema["type"])
+	}
+	return nil
+}
+
+func ExpectConformance(path string, method string, responseRecorder *httptest.ResponseRecorder) {
+	documentRecorder := httptest.NewRecorder()
+	goji.DefaultMux.ServeHTTP(documentRecorder, NewRequest("GET", "/openapi.json"))
+	Expect(documentRecorder.Code).To(Equal(200))
+	var document map[string]interface{}
+	Expect(json.Unmarshal(documentRecorder.Body.Bytes(), &document)).To(Succeed())
+
+	operation, ok := document["paths"].(map[string]interface{})[path].(map[string]interface{})[method].(map[string]interface{})
+	Expect(ok).To(BeTrue(), "%v %v is not in the OpenAPI document.", method, path)
+	responses := operation["responses"].(map[string]interface{})
+	response, ok := responses[fmt.Sprint(responseRecorder.Code)].(map[string]interface{})
+	if !ok {
+		response = responses["default"].(map[string]interface{})
+	}
+	schema := response["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+
+	var body interface{}
+	Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &body)).To(Succeed())
+	Expect(checkSchema(document, schema, body, "body")).To(Succeed())
+}
+
 type ApnsMockClient struct {
 	Response          *apns.PushNotificationResponse
 	NotificationsSent []*apns.PushNotification
@@ -59,6 +155,7 @@ func (self *ApnsMockClient) Send(pushNotification *apns.PushNotification) *apns.
 
 type MockApiCommunicator struct {
 	GetUrls     []string
+	DoUrls      []string
 	ResponseMap map[string]*struct {
 		Response *http.Response
 		Err      error
@@ -91,10 +188,7 @@ func (self *MockApiCommunicator) SetResponse(url string, status int, body string
 		ProtoMinor: 0,
 	}
 
-	if len(body) > 0 {
-		buf := bytes.NewBuffer([]byte(body))
-		getResponse.Response.Body = ioutil.NopCloser(buf)
-	}
+	getResponse.Response.Body = ioutil.NopCloser(bytes.NewBuffer([]byte(body)))
 
 	self.ResponseMap[url] = &getResponse
 }
@@ -110,17 +204,51 @@ func (self *MockApiCommunicator) Get(url string) (*http.Response, error) {
 	return getResponse.Response, getResponse.Err
 }
 
+func (self *MockApiCommunicator) Do(request *http.Request) (*http.Response, error) {
+	self.DoUrls = append(self.DoUrls, request.URL.String())
+	if response := self.ResponseMap[request.URL.Scheme+"://"+request.URL.Host+request.URL.Path]; response != nil {
+		return response.Response, response.Err
+	}
+	if request.URL.Host != "api.github.com" {
+		return http.DefaultClient.Do(request)
+	}
+	if strings.HasPrefix(request.URL.Path, "/repos/") && strings.Count(request.URL.Path, "/") == 3 {
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(`{"private":false}`))}, nil
+	}
+	return self.ResponseMap[""].Response, self.ResponseMap[""].Err
+}
+
+type BlockingApnsClient struct {
+	ApnsMockClient
+	Started chan bool
+	Release chan bool
+}
+
+func (self *BlockingApnsClient) Send(pushNotification *apns.PushNotification) *apns.PushNotificationResponse {
+	self.Started <- true
+	<-self.Release
+	return self.ApnsMockClient.Send(pushNotification)
+}
+
 var _ = Describe("Endpoint", func() {
 	var db *mgo.Database
 	var apnsClient *ApnsMockClient
+	var apnsCommunicator *server.APNSCommunicator
 	var apiCommunicator *MockApiCommunicator
+	var deviceKeys map[string]string
 
 	BeforeEach(func() {
+		deviceKeys = make(map[string]string)
 		apnsClient = &ApnsMockClient{}
-		apnsCommunicator := &server.APNSCommunicator{func() apns.APNSClient {
+		apnsCommunicator = &server.APNSCommunicator{func() apns.APNSClient {
 			return apnsClient
 		}}
 		apiCommunicator = NewMockApiCommunicator()
+		os.Setenv("GITLAB_TOKEN", TestGitlabToken)
+		os.Setenv("BITBUCKET_SECRET", TestBitbucketSecret)
+		os.Setenv("GENERIC_WEBHOOK_TOKEN", TestGenericToken)
+		os.Setenv("ADMIN_TOKEN", TestAdminToken)
+		server.Log.SetOutput(GinkgoWriter)
 		server.SetupRoutes(TestDatabaseName, apnsCommunicator, apiCommunicator)
 
 		session, err := mgo.Dial("mongo,localhost")
@@ -130,66 +258,489 @@ var _ = Describe("Endpoint", func() {
 
 		db.C("devices").DropCollection()
 		db.C("repositories").DropCollection()
+		db.C("users").DropCollection()
+		db.C("builds").DropCollection()
+		db.C("deliveries").RemoveAll(nil)
+		db.C("webhooks").DropCollection()
+		db.C("admins").DropCollection()
+		db.C("throttles").DropCollection()
 	})
 
 	AfterEach(func() {
 		goji.DefaultMux = web.New()
 	})
 
-	post := func(path string, data interface{}) {
-		request, _ := NewPOSTRequestWithJSON(path, data)
-		goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), request)
+	registerDevice := func(deviceId string) string {
+		request, _ := NewPOSTRequestWithJSON("/devices", server.DeviceDocument{DeviceId: deviceId})
+		responseRecorder := httptest.NewRecorder()
+		goji.DefaultMux.ServeHTTP(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(201))
+
+		var credentials server.DeviceCredentials
+		Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &credentials)).To(Succeed())
+		deviceKeys[deviceId] = credentials.Key
+		return credentials.Key
+	}
+
+	authorize := func(request *http.Request, deviceId string) *http.Request {
+		key, registered := deviceKeys[deviceId]
+		if !registered {
+			key = registerDevice(deviceId)
+		}
+		request.Header.Set("Authorization", "Bearer "+key)
+		return request
+	}
+
+	subscribe := func(deviceId string, repositoryName string) {
+		request, _ := NewPOSTRequestWithJSON("/devices/"+deviceId+"/repositories", struct{ Name string }{repositoryName})
+		goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), authorize(request, deviceId))
+	}
+
+	registerUser := func(userId string) string {
+		request, _ := NewPOSTRequestWithJSON("/users", struct{ UserId string }{userId})
+		responseRecorder := httptest.NewRecorder()
+		goji.DefaultMux.ServeHTTP(responseRecorder, request)
+		Expect(responseRecorder.Code).To(Equal(201))
+
+		var credentials server.UserCredentials
+		Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &credentials)).To(Succeed())
+		return credentials.Key
+	}
+
+	userRequest := func(method string, path string, userKey string, body interface{}) *http.Request {
+		request, _ := NewPOSTRequestWithJSON(path, body)
+		request.Method = method
+		request.Header.Set("Authorization", "Bearer "+userKey)
+		return request
+	}
+
+	linkGithubAccount := func(deviceId string, userId string, login string) string {
+		userKey := registerUser(userId)
+		goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), userRequest("POST", "/users/"+userId+"/devices", userKey,
+			server.DeviceCredentials{DeviceId: deviceId, Key: deviceKeys[deviceId]}))
+		Expect(db.C("users").UpdateId(userId, bson.M{"$set": bson.M{"githublogin": login, "githubtoken": "gho_" + login}})).To(Succeed())
+		return userKey
+	}
+
+	adminRequest := func(method string, path string) *http.Request {
+		request := NewRequest(method, path)
+		request.Header.Set("Authorization", "Bearer "+TestAdminToken)
+		return request
 	}
 
-	ItAllowsAnyRequestHeaders := func(path string) {
-		It("Allows any reuqest headers.", func() {
+	ItAllowsConfiguredRequestHeaders := func(path string) {
+		It("Allows only the configured request headers.", func() {
 			request, err := http.NewRequest("OPTIONS", path, nil)
 			Expect(err).NotTo(HaveOccurred())
 
-			request.Header.Add("Access-Control-Request-Headers", "Content-Type, X-Something-Else")
+			request.Header.Add("Access-Control-Request-Headers", "Content-Type, X-Something-Else, authorization")
 
 			responseRecorder := httptest.NewRecorder()
 			goji.DefaultMux.ServeHTTP(responseRecorder, request)
 
-			Expect(responseRecorder.Header().Get("Access-Control-Allow-Headers")).To(Equal("Content-Type, X-Something-Else"))
+			Expect(responseRecorder.Header().Get("Access-Control-Allow-Headers")).To(Equal("Content-Type, authorization"))
+			Expect(responseRecorder.Header().Get("Access-Control-Max-Age")).To(Equal("600"))
 		})
 	}
 
+	Describe("/healthz", func() {
+		It("reports the process is alive.", func() {
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, NewRequest("GET", "/healthz"))
+			Expect(responseRecorder.Code).To(Equal(200))
+			Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Status":"ok"}`))
+		})
+	})
+
+	Describe("request ids", func() {
+		It("echoes the X-Request-ID it was sent.", func() {
+			request := NewRequest("GET", "/healthz")
+			request.Header.Set("X-Request-ID", "upstream-id.1")
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, request)
+			Expect(responseRecorder.Header().Get("X-Request-ID")).To(Equal("upstream-id.1"))
+		})
+
+		It("makes up an X-Request-ID when none usable was sent.", func() {
+			request := NewRequest("GET", "/healthz")
+			request.Header.Set("X-Request-ID", "not\nusable")
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, request)
+			Expect(responseRecorder.Header().Get("X-Request-ID")).To(MatchRegexp("^[0-9a-f]{32}$"))
+		})
+
+		It("logs each request as JSON with its request id.", func() {
+			var output bytes.Buffer
+			server.Log.SetOutput(&output)
+
+			request, _ := NewPOSTRequestWithJSON("/devices", server.DeviceDocument{DeviceId: deviceToken("loggedDevice")})
+			request.Header.Set("X-Request-ID", "logged-request")
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(201))
+
+			var entry map[string]interface{}
+			Expect(json.Unmarshal(output.Bytes(), &entry)).To(Succeed())
+			Expect(entry).To(HaveKeyWithValue("level", "info"))
+			Expect(entry).To(HaveKeyWithValue("request_id", "logged-request"))
+			Expect(entry).To(HaveKeyWithValue("route", "/devices"))
+			Expect(entry).To(HaveKeyWithValue("method", "POST"))
+			Expect(entry).To(HaveKeyWithValue("status", 201.0))
+			Expect(entry).To(HaveKey("latency_ms"))
+		})
+
+		It("continues the W3C trace it was sent.", func() {
+			var output bytes.Buffer
+			server.Log.SetOutput(&output)
+
+			request, _ := NewPOSTRequestWithJSON("/devices", server.DeviceDocument{DeviceId: deviceToken("tracedDevice")})
+			request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(201))
+
+			var entry map[string]interface{}
+			Expect(json.Unmarshal(output.Bytes(), &entry)).To(Succeed())
+			Expect(entry).To(HaveKeyWithValue("trace_id", "4bf92f3577b34da6a3ce929d0e0e4736"))
+		})
+	})
+
+	Describe("/readyz", func() {
+		It("reports each dependency is ready.", func() {
+			apiCommunicator.SetResponse("https://api.github.com/rate_limit", 200, `{}`)
+
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, NewRequest("GET", "/readyz"))
+			Expect(responseRecorder.Code).To(Equal(200))
+			Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Status":"ok","Checks":[` +
+				`{"Name":"mongo","Status":"ok"},{"Name":"apns","Status":"ok"},` +
+				`{"Name":"github","Status":"ok"},{"Name":"pushes","Status":"ok"}]}`))
+		})
+
+		It("is unavailable when GitHub can not be reached.", func() {
+			apiCommunicator.SetResponse("https://api.github.com/rate_limit", 502, ``)
+
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, NewRequest("GET", "/readyz"))
+			Expect(responseRecorder.Code).To(Equal(503))
+
+			var report server.HealthReport
+			Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &report)).To(Succeed())
+			Expect(report.Status).To(Equal("unavailable"))
+			Expect(report.Checks[2]).To(Equal(server.HealthCheck{Name: "github", Status: "unavailable", Error: "GitHub responded 502."}))
+		})
+	})
+
+	Describe("when shutting down", func() {
+		var director *server.SidewinderDirector
+		var blockingClient *BlockingApnsClient
+
+		BeforeEach(func() {
+			blockingClient = &BlockingApnsClient{
+				ApnsMockClient: ApnsMockClient{Response: &apns.PushNotificationResponse{}},
+				Started:        make(chan bool, 1),
+				Release:        make(chan bool),
+			}
+			goji.DefaultMux = web.New()
+			var err error
+			director, err = server.SetupRoutes(TestDatabaseName, &server.APNSCommunicator{func() apns.APNSClient {
+				return blockingClient
+			}}, apiCommunicator)
+			Expect(err).NotTo(HaveOccurred())
+
+			request, _ := NewPOSTRequestWithJSON("/devices/"+deviceToken("token")+"/notifications", struct{ Alert string }{"Be excellent!"})
+			request = authorize(request, deviceToken("token"))
+			go goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), request)
+			Eventually(blockingClient.Started).Should(Receive())
+		})
+
+		It("waits for pushes in flight.", func() {
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				close(blockingClient.Release)
+			}()
+
+			closing := time.Now()
+			Expect(director.Close(time.Second)).To(Succeed())
+			Expect(time.Since(closing)).To(BeNumerically(">=", 50*time.Millisecond))
+			Expect(len(blockingClient.NotificationsSent)).To(Equal(1))
+		})
+
+		It("gives up waiting after the deadline.", func() {
+			Expect(director.Close(10 * time.Millisecond)).To(MatchError("Gave up waiting for push notifications after 10ms."))
+			close(blockingClient.Release)
+		})
+	})
+
+	Describe("over TLS", func() {
+		It("tells browsers to only use HTTPS.", func() {
+			request := NewRequest("GET", "/hello/rufus")
+			request.TLS = &tls.ConnectionState{}
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, request)
+			Expect(responseRecorder.Header().Get("Strict-Transport-Security")).To(Equal("max-age=31536000"))
+
+			responseRecorder = httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, NewRequest("GET", "/hello/rufus"))
+			Expect(responseRecorder.Header().Get("Strict-Transport-Security")).To(Equal(""))
+		})
+	})
+
+	Describe("with a CORS policy", func() {
+		allowedOrigin := "https://sidewinder.example.com"
+
+		BeforeEach(func() {
+			os.Setenv("CORS_ALLOWED_ORIGINS", allowedOrigin)
+			os.Setenv("CORS_ALLOWED_METHODS", "GET")
+			os.Setenv("CORS_ALLOW_CREDENTIALS", "true")
+			os.Setenv("CORS_MAX_AGE", "1h")
+			goji.DefaultMux = web.New()
+			server.SetupRoutes(TestDatabaseName, apnsCommunicator, apiCommunicator)
+		})
+
+		AfterEach(func() {
+			for _, name := range []string{"CORS_ALLOWED_ORIGINS", "CORS_ALLOWED_METHODS", "CORS_ALLOW_CREDENTIALS", "CORS_MAX_AGE"} {
+				os.Unsetenv(name)
+			}
+		})
+
+		preflight := func(origin string) *httptest.ResponseRecorder {
+			request := NewRequest("OPTIONS", "/devices/"+deviceToken("token")+"/repositories")
+			request.Header.Set("Origin", origin)
+			request.Header.Set("Access-Control-Request-Method", "POST")
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, request)
+			return responseRecorder
+		}
+
+		It("allows the configured origins with credentials.", func() {
+			responseRecorder := preflight(allowedOrigin)
+			Expect(responseRecorder.Header().Get("Access-Control-Allow-Origin")).To(Equal(allowedOrigin))
+			Expect(responseRecorder.Header().Get("Access-Control-Allow-Credentials")).To(Equal("true"))
+			Expect(responseRecorder.Header().Get("Access-Control-Allow-Methods")).To(Equal("GET"))
+			Expect(responseRecorder.Header().Get("Access-Control-Max-Age")).To(Equal("3600"))
+			Expect(responseRecorder.Header().Get("Vary")).To(Equal("Origin"))
+			Expect(responseRecorder.Header().Get("Allow")).To(Equal("GET, POST"))
+		})
+
+		It("does not allow other origins.", func() {
+			responseRecorder := preflight("https://evil.example.com")
+			Expect(responseRecorder.Header().Get("Access-Control-Allow-Origin")).To(Equal(""))
+			Expect(responseRecorder.Header().Get("Access-Control-Allow-Methods")).To(Equal(""))
+
+			request, _ := NewPOSTRequestWithJSON("/devices", server.DeviceDocument{DeviceId: deviceToken("token")})
+			request.Header.Set("Origin", "https://evil.example.com")
+			responseRecorder = httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, request)
+			Expect(responseRecorder.Header().Get("Access-Control-Allow-Origin")).To(Equal(""))
+			Expect(responseRecorder.Header().Get("Vary")).To(Equal("Origin"))
+		})
+
+		It("will not start when any origin is allowed with credentials.", func() {
+			os.Setenv("CORS_ALLOWED_ORIGINS", "*")
+			goji.DefaultMux = web.New()
+			_, err := server.SetupRoutes(TestDatabaseName, apnsCommunicator, apiCommunicator)
+			Expect(err).To(MatchError(`CORS_ALLOWED_ORIGINS must list the origins when CORS_ALLOW_CREDENTIALS is true, not "*".`))
+		})
+	})
+
+	Describe("/metrics", func() {
+		It("counts requests by route, method and status.", func() {
+			registerDevice(deviceToken("metricsDevice"))
+
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, NewRequest("GET", "/metrics"))
+			Expect(responseRecorder.Code).To(Equal(200))
+			Expect(responseRecorder.Body.String()).To(ContainSubstring(
+				`sidewinder_http_requests_total{code="201",method="POST",route="/devices"}`))
+		})
+	})
+
+	Describe("API versions", func() {
+		It("serves the API under /v1 without deprecation headers.", func() {
+			deviceId := deviceToken("versionedDevice")
+			request, _ := NewPOSTRequestWithJSON("/v1/devices", server.DeviceDocument{DeviceId: deviceId})
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, request)
+			Expect(responseRecorder.Code).To(Equal(201))
+			Expect(responseRecorder.Header().Get("Deprecation")).To(BeEmpty())
+
+			responseRecorder = httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, authorize(NewRequest("GET", "/v1/devices/"+deviceId+"/repositories"), deviceId))
+			Expect(responseRecorder.Code).To(Equal(200))
+			Expect(responseRecorder.Body.String()).To(MatchJSON(`[]`))
+		})
+
+		It("marks the unversioned routes as deprecated.", func() {
+			deviceId := deviceToken("legacyDevice")
+			registerDevice(deviceId)
+
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, authorize(NewRequest("GET", "/devices/"+deviceId+"/repositories"), deviceId))
+			Expect(responseRecorder.Code).To(Equal(200))
+			Expect(responseRecorder.Header().Get("Deprecation")).To(Equal(fmt.Sprintf("@%d", server.LegacyDeprecatedAt.Unix())))
+			Expect(responseRecorder.Header().Get("Sunset")).To(Equal(server.LegacyDeprecatedAt.AddDate(0, 6, 0).Format(http.TimeFormat)))
+			Expect(responseRecorder.Header().Get("Link")).To(Equal(`</v1/devices/` + deviceId + `/repositories>; rel="successor-version"`))
+		})
+	})
+
+	Describe("/openapi.json", func() {
+		It("describes every version of the API.", func() {
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, NewRequest("GET", "/v1/openapi.json"))
+			Expect(responseRecorder.Code).To(Equal(200))
+
+			var document struct {
+				OpenApi string
+				Servers []struct{ Url string }
+				Paths   map[string]map[string]struct{ Summary string }
+			}
+			Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &document)).To(Succeed())
+			Expect(document.OpenApi).To(HavePrefix("3."))
+			Expect(document.Servers[0].Url).To(Equal("/v1"))
+			Expect(document.Paths["/devices"]["post"].Summary).To(Equal("Register a device."))
+			Expect(document.Paths["/devices/{id}/repositories"]).To(HaveKey("get"))
+			Expect(document.Paths["/admin/webhooks/{webhookId}/replay"]).To(HaveKey("post"))
+		})
+
+		It("matches what the endpoints answer.", func() {
+			deviceId := deviceToken("documentedDevice")
+			request, _ := NewPOSTRequestWithJSON("/devices", server.DeviceDocument{DeviceId: deviceId})
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, request)
+			ExpectConformance("/devices", "post", responseRecorder)
+
+			var credentials server.DeviceCredentials
+			Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &credentials)).To(Succeed())
+			deviceKeys[deviceId] = credentials.Key
+			subscribe(deviceId, "billandted/excellentadventure")
+
+			responseRecorder = httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, authorize(NewRequest("GET", "/devices/"+deviceId+"/repositories"), deviceId))
+			Expect(responseRecorder.Code).To(Equal(200))
+			ExpectConformance("/devices/{id}/repositories", "get", responseRecorder)
+
+			responseRecorder = httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, NewRequest("GET", "/devices/"+deviceId+"/repositories"))
+			Expect(responseRecorder.Code).To(Equal(401))
+			ExpectConformance("/devices/{id}/repositories", "get", responseRecorder)
+
+			responseRecorder = httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, adminRequest("GET", "/admin/devices"))
+			Expect(responseRecorder.Code).To(Equal(200))
+			ExpectConformance("/admin/devices", "get", responseRecorder)
+		})
+	})
+
 	Describe("/devices", func() {
 		Describe("POST", func() {
-			It("is able to add a new device.", func() {
+			It("will throttle registrations from one client.", func() {
+				for i := 0; i < server.DeviceRegistrationsPerMinute; i++ {
+					registerDevice(deviceToken(fmt.Sprintf("device%v", i)))
+				}
+
+				request, _ := NewPOSTRequestWithJSON("/devices", server.DeviceDocument{DeviceId: deviceToken("oneTooMany")})
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(429))
+				Expect(responseRecorder.Header().Get("Retry-After")).To(Equal("2"))
+
+				request, _ = NewPOSTRequestWithJSON("/devices", server.DeviceDocument{DeviceId: deviceToken("oneTooMany")})
+				request.RemoteAddr = "192.0.2.2:1234"
+				responseRecorder = httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(201))
+			})
+
+			It("is able to add a new device and issues it a key.", func() {
 				responseRecorder := httptest.NewRecorder()
-				deviceInfo := server.DeviceDocument{"abracadabra"}
+				deviceInfo := server.DeviceDocument{DeviceId: deviceToken("abracadabra")}
 
-				request, data := NewPOSTRequestWithJSON("/devices", deviceInfo)
+				request, _ := NewPOSTRequestWithJSON("/devices", deviceInfo)
 				goji.DefaultMux.ServeHTTP(responseRecorder, request)
 
 				Expect(responseRecorder.Code).To(Equal(201))
-				Expect(responseRecorder.Body.String()).To(MatchJSON(data))
+				var credentials server.DeviceCredentials
+				Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &credentials)).To(Succeed())
+				Expect(credentials.DeviceId).To(Equal(deviceToken("abracadabra")))
+				Expect(credentials.Key).To(HaveLen(64))
 
 				deviceCollection := db.C("devices")
 				var result []server.DeviceDocument
 				deviceCollection.FindId(deviceInfo.DeviceId).All(&result)
-				Expect(result).To(Equal([]server.DeviceDocument{deviceInfo}))
+				Expect(len(result)).To(Equal(1))
+				Expect(result[0].DeviceId).To(Equal(deviceToken("abracadabra")))
+				Expect(result[0].KeyHash).NotTo(BeEmpty())
+				Expect(result[0].KeyHash).NotTo(Equal(credentials.Key))
+				Expect(result[0].HasKey(credentials.Key)).To(BeTrue())
 			})
 
-			It("can be called twice and will return a 200 the second time.", func() {
-				deviceInfo := server.DeviceDocument{"abracadabra"}
+			It("can be called twice with the device key and will return a 200 the second time.", func() {
+				deviceInfo := server.DeviceDocument{DeviceId: deviceToken("abracadabra")}
+				registerDevice(deviceInfo.DeviceId)
 
 				request, _ := NewPOSTRequestWithJSON("/devices", deviceInfo)
-				goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), request)
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceInfo.DeviceId))
+
+				Expect(responseRecorder.Code).To(Equal(200))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"DeviceId":"` + deviceToken("abracadabra") + `"}`))
+
+				deviceCollection := db.C("devices")
+				Expect(deviceCollection.Count()).To(Equal(1))
+			})
+
+			It("will not register an existing device again without its key.", func() {
+				deviceInfo := server.DeviceDocument{DeviceId: deviceToken("abracadabra")}
+				registerDevice(deviceInfo.DeviceId)
+
+				request, _ := NewPOSTRequestWithJSON("/devices", deviceInfo)
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(401))
+
+				request, _ = NewPOSTRequestWithJSON("/devices", deviceInfo)
+				request.Header.Set("Authorization", "Bearer guess")
+				responseRecorder = httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(403))
+			})
 
-				request, data := NewPOSTRequestWithJSON("/devices", deviceInfo)
+			It("refuses to hand out the key of a device registered before keys existed.", func() {
+				Expect(db.C("devices").Insert(server.DeviceDocument{DeviceId: deviceToken("abracadabra")})).To(Succeed())
+
+				request, _ := NewPOSTRequestWithJSON("/devices", server.DeviceDocument{DeviceId: deviceToken("abracadabra")})
 				responseRecorder := httptest.NewRecorder()
 				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(403))
+
+				responseRecorder = httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, adminRequest("POST", "/admin/devices/"+deviceToken("abracadabra")+"/credentials"))
+				Expect(responseRecorder.Code).To(Equal(200))
+				var credentials server.DeviceCredentials
+				Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &credentials)).To(Succeed())
+				Expect(credentials.Key).To(HaveLen(64))
+			})
 
+			It("issues a key to a device registered before keys existed while claims are open.", func() {
+				os.Setenv("LEGACY_KEY_CLAIMS_UNTIL", time.Now().AddDate(0, 0, 1).Format("2006-01-02"))
+				defer os.Unsetenv("LEGACY_KEY_CLAIMS_UNTIL")
+				goji.DefaultMux = web.New()
+				server.SetupRoutes(TestDatabaseName, apnsCommunicator, apiCommunicator)
+				Expect(db.C("devices").Insert(server.DeviceDocument{DeviceId: deviceToken("abracadabra")})).To(Succeed())
+
+				request, _ := NewPOSTRequestWithJSON("/devices", server.DeviceDocument{DeviceId: deviceToken("abracadabra")})
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
 				Expect(responseRecorder.Code).To(Equal(200))
-				Expect(responseRecorder.Body.String()).To(MatchJSON(data))
+				var credentials server.DeviceCredentials
+				Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &credentials)).To(Succeed())
+				Expect(credentials.Key).To(HaveLen(64))
 
-				deviceCollection := db.C("devices")
-				var result []server.DeviceDocument
-				deviceCollection.FindId(deviceInfo.DeviceId).All(&result)
-				Expect(result).To(Equal([]server.DeviceDocument{deviceInfo}))
+				request, _ = NewPOSTRequestWithJSON("/devices", server.DeviceDocument{DeviceId: deviceToken("abracadabra")})
+				responseRecorder = httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(401))
 			})
 
 			It("is not able to add a new device when device id is missing.", func() {
@@ -199,7 +750,8 @@ var _ = Describe("Endpoint", func() {
 				goji.DefaultMux.ServeHTTP(responseRecorder, request)
 
 				Expect(responseRecorder.Code).To(Equal(400))
-				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Error":"POST to /devices must be a JSON with a DeviceId property."}`))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"validation_failed","Message":"POST to /devices must be a JSON with a DeviceId property.","Error":"POST to /devices must be a JSON with a DeviceId property.",` +
+					`"Details":["Unknown field \"Nothing\".","DeviceId must be an APNS device token of 64 hexadecimal characters."]}`))
 
 				deviceCollection := db.C("devices")
 				Expect(deviceCollection.Count()).To(Equal(0))
@@ -212,7 +764,8 @@ var _ = Describe("Endpoint", func() {
 				goji.DefaultMux.ServeHTTP(responseRecorder, request)
 
 				Expect(responseRecorder.Code).To(Equal(400))
-				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Error":"POST to /devices must be a JSON with a DeviceId property."}`))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"validation_failed","Message":"POST to /devices must be a JSON with a DeviceId property.","Error":"POST to /devices must be a JSON with a DeviceId property.",` +
+					`"Details":["Unknown field \"Nothing\".","DeviceId must be an APNS device token of 64 hexadecimal characters."]}`))
 
 				deviceCollection := db.C("devices")
 				Expect(deviceCollection.Count()).To(Equal(0))
@@ -225,7 +778,8 @@ var _ = Describe("Endpoint", func() {
 				goji.DefaultMux.ServeHTTP(responseRecorder, request)
 
 				Expect(responseRecorder.Code).To(Equal(400))
-				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Error":"POST to /devices must be a JSON with a DeviceId property."}`))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"validation_failed","Message":"POST to /devices must be a JSON with a DeviceId property.","Error":"POST to /devices must be a JSON with a DeviceId property.",` +
+					`"Details":["Unknown field \"Nothing\".","DeviceId must be an APNS device token of 64 hexadecimal characters."]}`))
 
 				deviceCollection := db.C("devices")
 				Expect(deviceCollection.Count()).To(Equal(0))
@@ -238,12 +792,57 @@ var _ = Describe("Endpoint", func() {
 				goji.DefaultMux.ServeHTTP(responseRecorder, request)
 
 				Expect(responseRecorder.Code).To(Equal(400))
-				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Error":"POST to /devices must be a JSON with a DeviceId property."}`))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"validation_failed","Message":"POST to /devices must be a JSON with a DeviceId property.","Error":"POST to /devices must be a JSON with a DeviceId property.",` +
+					`"Details":["DeviceId must be an APNS device token of 64 hexadecimal characters."]}`))
 
 				deviceCollection := db.C("devices")
 				Expect(deviceCollection.Count()).To(Equal(0))
 			})
 
+			It("is not able to add a device whose id is not an APNS token.", func() {
+				responseRecorder := httptest.NewRecorder()
+
+				request, _ := NewPOSTRequestWithJSON("/devices", server.DeviceDocument{DeviceId: "abracadabra"})
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+
+				Expect(responseRecorder.Code).To(Equal(400))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"validation_failed","Message":"POST to /devices must be a JSON with a DeviceId property.","Error":"POST to /devices must be a JSON with a DeviceId property.",` +
+					`"Details":["DeviceId must be an APNS device token of 64 hexadecimal characters."]}`))
+			})
+
+			It("only accepts JSON bodies.", func() {
+				responseRecorder := httptest.NewRecorder()
+
+				request, _ := NewPOSTRequestWithJSON("/devices", server.DeviceDocument{DeviceId: deviceToken("abracadabra")})
+				request.Header.Set("Content-Type", "text/plain")
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+
+				Expect(responseRecorder.Code).To(Equal(415))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"unsupported_media_type","Message":"Request bodies must be sent as application/json.","Error":"Request bodies must be sent as application/json."}`))
+			})
+
+			It("refuses bodies that are too large.", func() {
+				responseRecorder := httptest.NewRecorder()
+
+				request, _ := NewPOSTRequestWithJSON("/devices", server.DeviceDocument{DeviceId: strings.Repeat("a", server.MaxBodyBytes)})
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+
+				Expect(responseRecorder.Code).To(Equal(413))
+				Expect(db.C("devices").Count()).To(Equal(0))
+			})
+
+			It("does not add a device when it can not send the answer in an acceptable media type.", func() {
+				responseRecorder := httptest.NewRecorder()
+
+				request, _ := NewPOSTRequestWithJSON("/devices", server.DeviceDocument{DeviceId: deviceToken("token")})
+				request.Header.Set("Accept", "text/html")
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+
+				Expect(responseRecorder.Code).To(Equal(406))
+				Expect(responseRecorder.Header().Get("Content-Type")).To(Equal("application/json"))
+				Expect(db.C("devices").Count()).To(Equal(0))
+			})
+
 			It("is not able to add a new device when body is not JSON.", func() {
 				responseRecorder := httptest.NewRecorder()
 
@@ -251,7 +850,8 @@ var _ = Describe("Endpoint", func() {
 				goji.DefaultMux.ServeHTTP(responseRecorder, request)
 
 				Expect(responseRecorder.Code).To(Equal(400))
-				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Error":"POST to /devices must be a JSON with a DeviceId property."}`))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"validation_failed","Message":"The request body is not valid JSON.","Error":"The request body is not valid JSON.",` +
+					`"Details":["invalid character 'r' looking for beginning of value"]}`))
 
 				deviceCollection := db.C("devices")
 				Expect(deviceCollection.Count()).To(Equal(0))
@@ -259,7 +859,7 @@ var _ = Describe("Endpoint", func() {
 		})
 
 		Describe("OPTIONS", func() {
-			ItAllowsAnyRequestHeaders("/devices")
+			ItAllowsConfiguredRequestHeaders("/devices")
 			It("Lists all the provided functions.", func() {
 				request, err := http.NewRequest("OPTIONS", "/devices", nil)
 				Expect(err).NotTo(HaveOccurred())
@@ -275,9 +875,9 @@ var _ = Describe("Endpoint", func() {
 		})
 		Describe("/:id", func() {
 			Describe("OPTIONS", func() {
-				ItAllowsAnyRequestHeaders("/devices/bibitty")
+				ItAllowsConfiguredRequestHeaders("/devices/" + deviceToken("bibitty"))
 				It("Lists all the provided functions.", func() {
-					request, err := http.NewRequest("OPTIONS", "/devices/bibitty", nil)
+					request, err := http.NewRequest("OPTIONS", "/devices/"+deviceToken("bibitty"), nil)
 					Expect(err).NotTo(HaveOccurred())
 
 					responseRecorder := httptest.NewRecorder()
@@ -292,43 +892,60 @@ var _ = Describe("Endpoint", func() {
 
 			Describe("DELETE", func() {
 				It("will be allowed from any origin domain", func() {
-					deviceInfo := server.DeviceDocument{"alakazham"}
-					postRequest, _ := NewPOSTRequestWithJSON("/devices", deviceInfo)
-					goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), postRequest)
-
 					recorder := httptest.NewRecorder()
-					goji.DefaultMux.ServeHTTP(recorder, NewRequest("DELETE", "/devices/alakazham"))
+					goji.DefaultMux.ServeHTTP(recorder, authorize(NewRequest("DELETE", "/devices/"+deviceToken("alakazham")), deviceToken("alakazham")))
 
 					Expect(recorder.Code).To(Equal(200))
 					Expect(recorder.Header().Get("Access-Control-Allow-Origin")).To(Equal("*"))
 				})
 
 				It("will delete a previously added device", func() {
-					deviceInfo := server.DeviceDocument{"alakazham"}
-					postRequest, data := NewPOSTRequestWithJSON("/devices", deviceInfo)
-					goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), postRequest)
-
 					recorder := httptest.NewRecorder()
-					goji.DefaultMux.ServeHTTP(recorder, NewRequest("DELETE", "/devices/alakazham"))
+					goji.DefaultMux.ServeHTTP(recorder, authorize(NewRequest("DELETE", "/devices/"+deviceToken("alakazham")), deviceToken("alakazham")))
 
 					Expect(recorder.Code).To(Equal(200))
-					Expect(recorder.Body.String()).To(MatchJSON(data))
+					Expect(recorder.Body.String()).To(MatchJSON(`{"DeviceId":"` + deviceToken("alakazham") + `"}`))
 
 					deviceCollection := db.C("devices")
 					Expect(deviceCollection.Count()).To(Equal(0))
 				})
+
+				It("will not delete a device without its key", func() {
+					registerDevice(deviceToken("alakazham"))
+
+					recorder := httptest.NewRecorder()
+					goji.DefaultMux.ServeHTTP(recorder, NewRequest("DELETE", "/devices/"+deviceToken("alakazham")))
+					Expect(recorder.Code).To(Equal(401))
+					Expect(recorder.Header().Get("WWW-Authenticate")).To(Equal("Bearer"))
+					Expect(recorder.Body.String()).To(MatchJSON(`{"Code":"unauthorized","Message":"Requests for a device must send its key as a Bearer token.","Error":"Requests for a device must send its key as a Bearer token."}`))
+
+					Expect(db.C("devices").Count()).To(Equal(1))
+				})
+
+				It("will not delete a device with another device's key", func() {
+					registerDevice(deviceToken("alakazham"))
+					registerDevice(deviceToken("hocuspocus"))
+
+					request := NewRequest("DELETE", "/devices/"+deviceToken("alakazham"))
+					request.Header.Set("Authorization", "Bearer "+deviceKeys[deviceToken("hocuspocus")])
+
+					recorder := httptest.NewRecorder()
+					goji.DefaultMux.ServeHTTP(recorder, request)
+					Expect(recorder.Code).To(Equal(403))
+					Expect(recorder.Body.String()).To(MatchJSON(`{"Code":"forbidden","Message":"The key sent is not valid for this device.","Error":"The key sent is not valid for this device."}`))
+
+					Expect(db.C("devices").Count()).To(Equal(2))
+				})
 			})
 
 			Describe("/repositories", func() {
-				deviceId := "repositoryTestDevice"
+				deviceId := deviceToken("repositoryTestDevice")
 				BeforeEach(func() {
-					deviceInfo := server.DeviceDocument{deviceId}
-					request, _ := NewPOSTRequestWithJSON("/devices", deviceInfo)
-					goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), request)
+					registerDevice(deviceId)
 				})
 
 				Describe("OPTIONS", func() {
-					ItAllowsAnyRequestHeaders("/devices/" + deviceId + "/repositories")
+					ItAllowsConfiguredRequestHeaders("/devices/" + deviceId + "/repositories")
 					It("Lists all the provided functions.", func() {
 						request, err := http.NewRequest("OPTIONS", "/devices/"+deviceId+"/repositories", nil)
 						Expect(err).NotTo(HaveOccurred())
@@ -349,7 +966,7 @@ var _ = Describe("Endpoint", func() {
 						Expect(err).NotTo(HaveOccurred())
 
 						responseRecorder := httptest.NewRecorder()
-						goji.DefaultMux.ServeHTTP(responseRecorder, request)
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceId))
 						Expect(responseRecorder.Code).To(Equal(200))
 						Expect(responseRecorder.Header().Get("Access-Control-Allow-Origin")).To(Equal("*"))
 					})
@@ -359,28 +976,142 @@ var _ = Describe("Endpoint", func() {
 						Expect(err).NotTo(HaveOccurred())
 
 						responseRecorder := httptest.NewRecorder()
-						goji.DefaultMux.ServeHTTP(responseRecorder, request)
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceId))
 						Expect(responseRecorder.Code).To(Equal(200))
 						Expect(responseRecorder.Body.String()).To(MatchJSON(`[]`))
+						Expect(responseRecorder.Header().Get("Content-Type")).To(Equal("application/json"))
+					})
+
+					It("will indent the response when asked to be pretty.", func() {
+						subscribe(deviceId, "billandted/excellentadventure")
+
+						responseRecorder := httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(NewRequest("GET", "/devices/"+deviceId+"/repositories?pretty"), deviceId))
+						Expect(responseRecorder.Code).To(Equal(200))
+						Expect(responseRecorder.Body.String()).To(Equal("[\n  {\n    \"Name\": \"billandted/excellentadventure\"\n  }\n]\n"))
+					})
+
+					It("will answer 304 when the ETag has not changed.", func() {
+						responseRecorder := httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(NewRequest("GET", "/devices/"+deviceId+"/repositories"), deviceId))
+						etag := responseRecorder.Header().Get("ETag")
+						Expect(etag).NotTo(BeEmpty())
+
+						request := NewRequest("GET", "/devices/"+deviceId+"/repositories")
+						request.Header.Set("If-None-Match", etag)
+						responseRecorder = httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceId))
+						Expect(responseRecorder.Code).To(Equal(304))
+						Expect(responseRecorder.Body.Len()).To(Equal(0))
+
+						subscribe(deviceId, "billandted/excellentadventure")
+						responseRecorder = httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceId))
+						Expect(responseRecorder.Code).To(Equal(200))
+						Expect(responseRecorder.Header().Get("ETag")).NotTo(Equal(etag))
+					})
+
+					It("will answer in msgpack when asked to.", func() {
+						request := NewRequest("GET", "/devices/"+deviceId+"/repositories")
+						request.Header.Set("Accept", "application/msgpack, application/json;q=0.5")
+
+						responseRecorder := httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceId))
+						Expect(responseRecorder.Code).To(Equal(200))
+						Expect(responseRecorder.Header().Get("Content-Type")).To(Equal("application/msgpack"))
+						Expect(responseRecorder.Body.Bytes()).To(Equal([]byte{0x90}))
+					})
+
+					It("will refuse media types it cannot produce.", func() {
+						request := NewRequest("GET", "/devices/"+deviceId+"/repositories")
+						request.Header.Set("Accept", "text/html")
+
+						responseRecorder := httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceId))
+						Expect(responseRecorder.Code).To(Equal(406))
+						Expect(responseRecorder.Header().Get("Content-Type")).To(Equal("application/json"))
+						Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"not_acceptable","Message":"Responses can only be sent as application/json or application/msgpack.","Error":"Responses can only be sent as application/json or application/msgpack."}`))
 					})
 
 					It("will show all repositories posted to this device", func() {
 						repositoryName1 := "billandted/excellentadventure"
-						post("/devices/"+deviceId+"/repositories", struct{ Name string }{repositoryName1})
+						subscribe(deviceId, repositoryName1)
 						repositoryName2 := "billandted/bogusjourney"
-						post("/devices/"+deviceId+"/repositories", struct{ Name string }{repositoryName2})
-						post("/devices/differentDevice/repositories", struct{ Name string }{"red herring"})
+						subscribe(deviceId, repositoryName2)
+						request, _ := NewPOSTRequestWithJSON("/devices/"+deviceToken("differentDevice")+"/repositories",
+							struct{ Name string }{"rufus/time-machine"})
+						responseRecorder := httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceToken("differentDevice")))
+						Expect(responseRecorder.Code).To(Equal(201))
 
 						request, err := http.NewRequest("GET", "/devices/"+deviceId+"/repositories", nil)
 						Expect(err).NotTo(HaveOccurred())
 
-						responseRecorder := httptest.NewRecorder()
-						goji.DefaultMux.ServeHTTP(responseRecorder, request)
+						responseRecorder = httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceId))
 						Expect(responseRecorder.Code).To(Equal(200))
 						Expect(responseRecorder.Body.String()).To(MatchJSON(`[{"Name":"` + repositoryName1 + `"},{"Name":"` + repositoryName2 + `"}]`))
 					})
+
+					It("will show the repositories of the user of this device", func() {
+						userKey := linkGithubAccount(deviceId, "bill", "billandted")
+						subscribe(deviceId, "billandted/*")
+						goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), userRequest("POST", "/users/bill/repositories", userKey,
+							server.SubscriptionMessage{Name: "rufus/time-machine"}))
+
+						request, err := http.NewRequest("GET", "/devices/"+deviceId+"/repositories", nil)
+						Expect(err).NotTo(HaveOccurred())
+
+						responseRecorder := httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceId))
+						Expect(responseRecorder.Code).To(Equal(200))
+						Expect(responseRecorder.Body.String()).To(MatchJSON(`[{"Name":"billandted/*"},{"Name":"rufus/time-machine","Via":"user"}]`))
+					})
 				})
 				Describe("POST", func() {
+					It("rejects names that are not owner/name.", func() {
+						request, _ := NewPOSTRequestWithJSON("/devices/"+deviceId+"/repositories", `{"Name":"red herring","Mode":"theirs","Color":"red"}`)
+
+						responseRecorder := httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceId))
+						Expect(responseRecorder.Code).To(Equal(400))
+						Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"validation_failed",` +
+							`"Message":"A subscription must be a JSON with a valid Name and an optional Mode.","Error":"A subscription must be a JSON with a valid Name and an optional Mode.","Details":[` +
+							`"Unknown field \"Color\".",` +
+							`"Name must be owner/name, owner/*, @org/team or source:name.",` +
+							`"Mode must be \"all\" or \"mine\"."]}`))
+					})
+
+					It("rejects subscriptions to its own commits without a linked GitHub account.", func() {
+						message := server.SubscriptionMessage{Name: "billandted/excellentadventure", Mode: server.SubscriptionMine}
+						request, _ := NewPOSTRequestWithJSON("/devices/"+deviceId+"/repositories", message)
+						responseRecorder := httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceId))
+						Expect(responseRecorder.Code).To(Equal(400))
+						Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"validation_failed",` +
+							`"Message":"Subscriptions to your own commits need a user with a linked GitHub account.",` +
+							`"Error":"Subscriptions to your own commits need a user with a linked GitHub account."}`))
+
+						linkGithubAccount(deviceId, "bill", "bill-s-preston")
+						request, _ = NewPOSTRequestWithJSON("/devices/"+deviceId+"/repositories", message)
+						responseRecorder = httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceId))
+						Expect(responseRecorder.Code).To(Equal(201))
+					})
+
+					It("rejects a body that is not JSON.", func() {
+						request, _ := NewPOSTRequestWithJSON("/devices/"+deviceId+"/repositories", `{"Name":}`)
+
+						responseRecorder := httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceId))
+						Expect(responseRecorder.Code).To(Equal(400))
+
+						var apiError server.ErrorJson
+						Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &apiError)).To(Succeed())
+						Expect(apiError.Code).To(Equal("validation_failed"))
+						Expect(apiError.Message).To(Equal("The request body is not valid JSON."))
+						Expect(apiError.Details).To(HaveLen(1))
+					})
 					It("will be allowed from any origin domain", func() {
 						repositoryName := "billandted/excellentadventure"
 
@@ -388,7 +1119,7 @@ var _ = Describe("Endpoint", func() {
 							struct{ Name string }{repositoryName})
 
 						responseRecorder := httptest.NewRecorder()
-						goji.DefaultMux.ServeHTTP(responseRecorder, request)
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceId))
 						Expect(responseRecorder.Code).To(Equal(201))
 						Expect(responseRecorder.Header().Get("Access-Control-Allow-Origin")).To(Equal("*"))
 					})
@@ -400,20 +1131,43 @@ var _ = Describe("Endpoint", func() {
 							struct{ Name string }{repositoryName})
 
 						responseRecorder := httptest.NewRecorder()
-						goji.DefaultMux.ServeHTTP(responseRecorder, request)
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceId))
 						Expect(responseRecorder.Code).To(Equal(201))
 						Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Name":"` + repositoryName + `"}`))
 					})
 
+					It("will only subscribe to public repositories without a linked GitHub account.", func() {
+						apiCommunicator.SetResponse("https://api.github.com/repos/rufus/time-machine", 200, `{"private":true}`)
+
+						request, _ := NewPOSTRequestWithJSON("/devices/"+deviceId+"/repositories",
+							struct{ Name string }{"rufus/time-machine"})
+						responseRecorder := httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceId))
+						Expect(responseRecorder.Code).To(Equal(403))
+						Expect(responseRecorder.Body.String()).To(MatchJSON(
+							`{"Code":"forbidden","Message":"Only public repositories can be subscribed to without a linked GitHub account.","Error":"Only public repositories can be subscribed to without a linked GitHub account."}`))
+
+					})
+
+					It("will only subscribe to every repository of an owner with a linked GitHub account.", func() {
+						request, _ := NewPOSTRequestWithJSON("/devices/"+deviceId+"/repositories",
+							struct{ Name string }{"billandted/*"})
+						responseRecorder := httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceId))
+						Expect(responseRecorder.Code).To(Equal(400))
+						Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"validation_failed",` +
+							`"Message":"Subscriptions to every repository of an owner need a user with a linked GitHub account.","Error":"Subscriptions to every repository of an owner need a user with a linked GitHub account."}`))
+					})
+
 					It("will return 200 when value is already there", func() {
 						repositoryName := "billandted/excellentadventure"
 
-						post("/devices/"+deviceId+"/repositories", struct{ Name string }{repositoryName})
+						subscribe(deviceId, repositoryName)
 						request, _ := NewPOSTRequestWithJSON("/devices/"+deviceId+"/repositories",
 							struct{ Name string }{repositoryName})
 
 						responseRecorder := httptest.NewRecorder()
-						goji.DefaultMux.ServeHTTP(responseRecorder, request)
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceId))
 						Expect(responseRecorder.Code).To(Equal(200))
 						Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Name":"` + repositoryName + `"}`))
 					})
@@ -422,9 +1176,9 @@ var _ = Describe("Endpoint", func() {
 
 			Describe("/notifications", func() {
 				Describe("OPTIONS", func() {
-					ItAllowsAnyRequestHeaders("/devices/token/notifications")
+					ItAllowsConfiguredRequestHeaders("/devices/" + deviceToken("token") + "/notifications")
 					It("Lists all the provided functions.", func() {
-						request, err := http.NewRequest("OPTIONS", "/devices/token/notifications", nil)
+						request, err := http.NewRequest("OPTIONS", "/devices/"+deviceToken("token")+"/notifications", nil)
 						Expect(err).NotTo(HaveOccurred())
 
 						responseRecorder := httptest.NewRecorder()
@@ -441,47 +1195,656 @@ var _ = Describe("Endpoint", func() {
 					Describe("when sent a notification", func() {
 						It("and can forward it to Apple it will respond success", func() {
 							message := struct{ Alert string }{"Something important!"}
-							request, data := NewPOSTRequestWithJSON("/devices/token/notifications", message)
+							request, data := NewPOSTRequestWithJSON("/devices/"+deviceToken("token")+"/notifications", message)
 
 							apnsClient.Response = apns.NewPushNotificationResponse()
 
 							responseRecorder := httptest.NewRecorder()
-							goji.DefaultMux.ServeHTTP(responseRecorder, request)
+							goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceToken("token")))
 							Expect(responseRecorder.Code).To(Equal(201))
 							Expect(responseRecorder.Body.String()).To(MatchJSON(data))
 							Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
-							Expect(apnsClient.NotificationsSent[0].DeviceToken).To(Equal("token"))
+							Expect(apnsClient.NotificationsSent[0].DeviceToken).To(Equal(deviceToken("token")))
 							expectedPayload := `{"aps" : {"alert":"Something important!", "badge" : -1}}`
 							Expect(apnsClient.NotificationsSent[0].PayloadJSON()).To(MatchJSON(expectedPayload))
 						})
 
 						It("and can not forward it to Apple it will respond error", func() {
 							message := struct{ Alert string }{"Something important!"}
-							request, _ := NewPOSTRequestWithJSON("/devices/token/notifications", message)
+							request, _ := NewPOSTRequestWithJSON("/devices/"+deviceToken("token")+"/notifications", message)
 
 							apnsClient.Response = apns.NewPushNotificationResponse()
 							apnsClient.Response.Error = errors.New("Oh no!")
 
 							responseRecorder := httptest.NewRecorder()
-							goji.DefaultMux.ServeHTTP(responseRecorder, request)
-							expectedError := `{"Error" : "Oh no!"}`
-							Expect(responseRecorder.Code).To(Equal(500))
+							goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceToken("token")))
+							expectedError := `{"Code":"upstream_failed","Message":"APNS did not accept the push notification.","Error":"APNS did not accept the push notification.","Details":["Oh no!"]}`
+							Expect(responseRecorder.Code).To(Equal(502))
 							Expect(responseRecorder.Body.String()).To(MatchJSON(expectedError))
 						})
+
+						It("in a media type it can not answer in will not send anything", func() {
+							message := struct{ Alert string }{"Something important!"}
+							registerDevice(deviceToken("token"))
+							request, _ := NewPOSTRequestWithJSON("/devices/"+deviceToken("token")+"/notifications", message)
+							request.Header.Set("Accept", "text/html")
+
+							responseRecorder := httptest.NewRecorder()
+							goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceToken("token")))
+							Expect(responseRecorder.Code).To(Equal(406))
+							Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+						})
+
+						It("without the device key will not send anything", func() {
+							message := struct{ Alert string }{"Something important!"}
+							registerDevice(deviceToken("token"))
+							request, _ := NewPOSTRequestWithJSON("/devices/"+deviceToken("token")+"/notifications", message)
+
+							responseRecorder := httptest.NewRecorder()
+							goji.DefaultMux.ServeHTTP(responseRecorder, request)
+							Expect(responseRecorder.Code).To(Equal(401))
+							Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+						})
+
+						It("for an unknown device will not send anything", func() {
+							message := struct{ Alert string }{"Something important!"}
+							request, _ := NewPOSTRequestWithJSON("/devices/"+deviceToken("token")+"/notifications", message)
+							request.Header.Set("Authorization", "Bearer guess")
+
+							responseRecorder := httptest.NewRecorder()
+							goji.DefaultMux.ServeHTTP(responseRecorder, request)
+							Expect(responseRecorder.Code).To(Equal(403))
+							Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+						})
+
+						It("too often for one device will be throttled", func() {
+							message := struct{ Alert string }{"Something important!"}
+							apnsClient.Response = apns.NewPushNotificationResponse()
+							send := func(deviceId string) *httptest.ResponseRecorder {
+								request, _ := NewPOSTRequestWithJSON("/devices/"+deviceId+"/notifications", message)
+								responseRecorder := httptest.NewRecorder()
+								goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceId))
+								return responseRecorder
+							}
+
+							for i := 0; i < server.DeviceNotificationsPerMinute; i++ {
+								Expect(send(deviceToken("token")).Code).To(Equal(201))
+							}
+							responseRecorder := send(deviceToken("token"))
+							Expect(responseRecorder.Code).To(Equal(429))
+							Expect(responseRecorder.Header().Get("Retry-After")).To(Equal("6"))
+							Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"rate_limited","Message":"Too many requests, try again later.","Error":"Too many requests, try again later."}`))
+							Expect(len(apnsClient.NotificationsSent)).To(Equal(server.DeviceNotificationsPerMinute))
+
+							request, _ := NewPOSTRequestWithJSON("/devices/"+deviceToken("token")+"/notifications", message)
+							request.RemoteAddr = "192.0.2.2:1234"
+							responseRecorder = httptest.NewRecorder()
+							goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceToken("token")))
+							Expect(responseRecorder.Code).To(Equal(429))
+
+							Expect(send(deviceToken("otherToken")).Code).To(Equal(201))
+						})
+
+						It("without the device key will not use up the limit of the device", func() {
+							message := struct{ Alert string }{"Something important!"}
+							apnsClient.Response = apns.NewPushNotificationResponse()
+							registerDevice(deviceToken("token"))
+
+							var responseRecorder *httptest.ResponseRecorder
+							for i := 0; i <= server.FailedAuthsPerMinute; i++ {
+								request, _ := NewPOSTRequestWithJSON("/devices/"+deviceToken("token")+"/notifications", message)
+								request.RemoteAddr = "192.0.2.66:1234"
+								responseRecorder = httptest.NewRecorder()
+								goji.DefaultMux.ServeHTTP(responseRecorder, request)
+							}
+							Expect(responseRecorder.Code).To(Equal(429))
+
+							request, _ := NewPOSTRequestWithJSON("/devices/"+deviceToken("token")+"/notifications", message)
+							responseRecorder = httptest.NewRecorder()
+							goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceToken("token")))
+							Expect(responseRecorder.Code).To(Equal(201))
+						})
+					})
+				})
+			})
+
+			Describe("/credentials", func() {
+				Describe("POST", func() {
+					It("issues a new key and retires the old one", func() {
+						oldKey := registerDevice(deviceToken("shazam"))
+						request, _ := NewPOSTRequestWithJSON("/devices/"+deviceToken("shazam")+"/credentials", nil)
+
+						responseRecorder := httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceToken("shazam")))
+						Expect(responseRecorder.Code).To(Equal(200))
+
+						var credentials server.DeviceCredentials
+						Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &credentials)).To(Succeed())
+						Expect(credentials.DeviceId).To(Equal(deviceToken("shazam")))
+						Expect(credentials.Key).NotTo(Equal(oldKey))
+
+						request = NewRequest("GET", "/devices/"+deviceToken("shazam")+"/repositories")
+						request.Header.Set("Authorization", "Bearer "+oldKey)
+						responseRecorder = httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, request)
+						Expect(responseRecorder.Code).To(Equal(403))
+
+						request = NewRequest("GET", "/devices/"+deviceToken("shazam")+"/repositories")
+						request.Header.Set("Authorization", "Bearer "+credentials.Key)
+						responseRecorder = httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, request)
+						Expect(responseRecorder.Code).To(Equal(200))
+					})
+
+					It("requires the current key", func() {
+						registerDevice(deviceToken("shazam"))
+						request, _ := NewPOSTRequestWithJSON("/devices/"+deviceToken("shazam")+"/credentials", nil)
+
+						responseRecorder := httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, request)
+						Expect(responseRecorder.Code).To(Equal(401))
 					})
 				})
 			})
 		})
 	})
 
+	Describe("/users", func() {
+		Describe("POST", func() {
+			It("is able to add a new user and issues it a key.", func() {
+				request, _ := NewPOSTRequestWithJSON("/users", struct{ UserId string }{"bill"})
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+
+				Expect(responseRecorder.Code).To(Equal(201))
+				var credentials server.UserCredentials
+				Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &credentials)).To(Succeed())
+				Expect(credentials.UserId).To(Equal("bill"))
+				Expect(credentials.Key).To(HaveLen(64))
+			})
+
+			It("will not register an existing user again without its key.", func() {
+				registerUser("bill")
+
+				request, _ := NewPOSTRequestWithJSON("/users", struct{ UserId string }{"bill"})
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(401))
+			})
+
+			It("is not able to add a user when user id is missing.", func() {
+				request, _ := NewPOSTRequestWithJSON("/users", struct{ Nothing string }{"nothing"})
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+
+				Expect(responseRecorder.Code).To(Equal(400))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"validation_failed","Message":"POST to /users must be a JSON with a UserId property.","Error":"POST to /users must be a JSON with a UserId property."}`))
+			})
+		})
+
+		Describe("/:id/devices", func() {
+			var userKey string
+
+			BeforeEach(func() {
+				userKey = registerUser("bill")
+				registerDevice(deviceToken("iphone"))
+				registerDevice(deviceToken("ipad"))
+			})
+
+			attach := func(userId string, userKey string, deviceId string) *httptest.ResponseRecorder {
+				request := userRequest("POST", "/users/"+userId+"/devices", userKey,
+					server.DeviceCredentials{DeviceId: deviceId, Key: deviceKeys[deviceId]})
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+				return responseRecorder
+			}
+
+			It("attaches devices to the user and lists them.", func() {
+				Expect(attach("bill", userKey, deviceToken("iphone")).Code).To(Equal(201))
+				Expect(attach("bill", userKey, deviceToken("ipad")).Code).To(Equal(201))
+				Expect(attach("bill", userKey, deviceToken("ipad")).Code).To(Equal(200))
+
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, userRequest("GET", "/users/bill/devices", userKey, nil))
+				Expect(responseRecorder.Code).To(Equal(200))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(
+					`[{"DeviceId":"` + deviceToken("iphone") + `","UserId":"bill"},{"DeviceId":"` + deviceToken("ipad") + `","UserId":"bill"}]`))
+			})
+
+			It("requires the key of the device being attached.", func() {
+				request := userRequest("POST", "/users/bill/devices", userKey,
+					server.DeviceCredentials{DeviceId: deviceToken("iphone"), Key: deviceKeys[deviceToken("ipad")]})
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(403))
+			})
+
+			It("will not attach a device that belongs to another user.", func() {
+				tedKey := registerUser("ted")
+				Expect(attach("bill", userKey, deviceToken("iphone")).Code).To(Equal(201))
+
+				responseRecorder := attach("ted", tedKey, deviceToken("iphone"))
+				Expect(responseRecorder.Code).To(Equal(409))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"conflict","Message":"The device is already attached to another user.","Error":"The device is already attached to another user."}`))
+			})
+
+			It("attaches a device to only one of two users asking at once.", func() {
+				tedKey := registerUser("ted")
+				codes := make(chan int, 2)
+				for userId, key := range map[string]string{"bill": userKey, "ted": tedKey} {
+					go func(userId string, key string) {
+						defer GinkgoRecover()
+						codes <- attach(userId, key, deviceToken("iphone")).Code
+					}(userId, key)
+				}
+
+				Expect([]int{<-codes, <-codes}).To(ConsistOf(201, 409))
+			})
+
+			It("requires the user key.", func() {
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, NewRequest("GET", "/users/bill/devices"))
+				Expect(responseRecorder.Code).To(Equal(401))
+
+				responseRecorder = attach("bill", deviceKeys[deviceToken("iphone")], deviceToken("iphone"))
+				Expect(responseRecorder.Code).To(Equal(403))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"forbidden","Message":"The key sent is not valid for this user.","Error":"The key sent is not valid for this user."}`))
+			})
+
+			Describe("and repositories", func() {
+				repositoryName := "billandted/excellentadventure"
+
+				BeforeEach(func() {
+					attach("bill", userKey, deviceToken("iphone"))
+					attach("bill", userKey, deviceToken("ipad"))
+					responseRecorder := httptest.NewRecorder()
+					goji.DefaultMux.ServeHTTP(responseRecorder,
+						userRequest("POST", "/users/bill/repositories", userKey, struct{ Name string }{repositoryName}))
+					Expect(responseRecorder.Code).To(Equal(201))
+				})
+
+				It("lists the repositories of the user.", func() {
+					responseRecorder := httptest.NewRecorder()
+					goji.DefaultMux.ServeHTTP(responseRecorder, userRequest("GET", "/users/bill/repositories", userKey, nil))
+					Expect(responseRecorder.Code).To(Equal(200))
+					Expect(responseRecorder.Body.String()).To(MatchJSON(`[{"Name":"` + repositoryName + `"}]`))
+				})
+
+				It("notifies every device of the user once.", func() {
+					apnsClient.Response = &apns.PushNotificationResponse{}
+					subscribe(deviceToken("iphone"), repositoryName)
+
+					request, _ := NewPOSTRequestWithJSON("/hooks/github",
+						`{"name":"billandted/excellentadventure","context":"","state":"failure","description":"Bogus!","branches":[{"Name":"master"}]}`)
+					goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), request)
+
+					Expect(len(apnsClient.NotificationsSent)).To(Equal(2))
+					Expect(apnsClient.NotificationsSent[0].DeviceToken).To(Equal(deviceToken("iphone")))
+					Expect(apnsClient.NotificationsSent[1].DeviceToken).To(Equal(deviceToken("ipad")))
+				})
+			})
+
+			Describe("and repositories of their own commits", func() {
+				repositoryName := "billandted/excellentadventure"
+
+				BeforeEach(func() {
+					attach("bill", userKey, deviceToken("iphone"))
+					Expect(db.C("users").UpdateId("bill", bson.M{"$set": bson.M{"githublogin": "bill-s-preston"}})).To(Succeed())
+					responseRecorder := httptest.NewRecorder()
+					goji.DefaultMux.ServeHTTP(responseRecorder, userRequest("POST", "/users/bill/repositories", userKey,
+						server.SubscriptionMessage{Name: repositoryName, Mode: server.SubscriptionMine}))
+					Expect(responseRecorder.Code).To(Equal(201))
+					apnsClient.Response = &apns.PushNotificationResponse{}
+				})
+
+				notify := func(author string) {
+					request, _ := NewPOSTRequestWithJSON("/hooks/github",
+						`{"name":"billandted/excellentadventure","context":"","state":"failure","description":"Bogus!","branches":[{"Name":"master"}],`+
+							`"commit":{"author":{"login":"`+author+`"},"committer":{"login":"web-flow"}}}`)
+					goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), request)
+				}
+
+				It("lists the mode of the subscription.", func() {
+					responseRecorder := httptest.NewRecorder()
+					goji.DefaultMux.ServeHTTP(responseRecorder, userRequest("GET", "/users/bill/repositories", userKey, nil))
+					Expect(responseRecorder.Body.String()).To(MatchJSON(`[{"Name":"` + repositoryName + `","Mode":"mine"}]`))
+				})
+
+				It("notifies the devices of the user for commits by their GitHub account.", func() {
+					notify("bill-s-preston")
+					Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
+					Expect(apnsClient.NotificationsSent[0].DeviceToken).To(Equal(deviceToken("iphone")))
+				})
+
+				It("does not notify the user for commits by anyone else.", func() {
+					notify("ted-theodore-logan")
+					Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+				})
+
+				It("notifies the devices of the user for pull requests they take part in.", func() {
+					apiCommunicator.SetResponse("https://api.github.com/repos/billandted/excellentadventure/commits/0ddba11/pulls", 200,
+						`[{"user":{"login":"ted-theodore-logan"},"assignees":[{"login":"bill-s-preston"}],"requested_reviewers":[]}]`)
+
+					request, _ := NewPOSTRequestWithJSON("/hooks/github",
+						`{"name":"billandted/excellentadventure","sha":"0ddba11","context":"","state":"failure","description":"Bogus!",`+
+							`"branches":[{"Name":"master"}],"commit":{"author":{"login":"ted-theodore-logan"}}}`)
+					goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), request)
+					Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
+					Expect(apnsClient.NotificationsSent[0].DeviceToken).To(Equal(deviceToken("iphone")))
+				})
+
+				It("notifies for every commit once subscribed to all of them again.", func() {
+					goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), userRequest("POST", "/users/bill/repositories", userKey,
+						server.SubscriptionMessage{Name: repositoryName, Mode: server.SubscriptionAll}))
+
+					notify("ted-theodore-logan")
+					Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
+				})
+
+				It("rejects unknown modes.", func() {
+					responseRecorder := httptest.NewRecorder()
+					goji.DefaultMux.ServeHTTP(responseRecorder, userRequest("POST", "/users/bill/repositories", userKey,
+						server.SubscriptionMessage{Name: repositoryName, Mode: "theirs"}))
+					Expect(responseRecorder.Code).To(Equal(400))
+					Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"validation_failed","Message":"A subscription must be a JSON with a valid Name and an optional Mode.","Error":"A subscription must be a JSON with a valid Name and an optional Mode.",` +
+						`"Details":["Mode must be \"all\" or \"mine\"."]}`))
+				})
+			})
+		})
+	})
+
+	Describe("/auth/github", func() {
+		var fakeGithub *httptest.Server
+		var userKey string
+		var traceparents []string
+		var teamRepositories string
+		var director *server.SidewinderDirector
+
+		BeforeEach(func() {
+			traceparents = nil
+			teamRepositories = `[{"full_name":"billandted/excellentadventure"}]`
+			fakeGithub = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				traceparents = append(traceparents, request.Header.Get("traceparent"))
+				switch {
+				case request.URL.Path == "/login/oauth/access_token":
+					request.ParseForm()
+					if request.Form.Get("code") == "c0de" && request.Form.Get("client_secret") == "shh" {
+						writer.Write([]byte(`{"access_token":"gho_excellent","token_type":"bearer"}`))
+					} else {
+						writer.Write([]byte(`{"error":"bad_verification_code"}`))
+					}
+				case request.Header.Get("Authorization") != "token gho_excellent":
+					writer.WriteHeader(401)
+				case request.URL.Path == "/user":
+					writer.Write([]byte(`{"login":"theodore"}`))
+				case request.URL.Path == "/repos/billandted/excellentadventure":
+					writer.Write([]byte(`{"full_name":"billandted/excellentadventure"}`))
+				case request.URL.Path == "/user/memberships/orgs/billandted":
+					writer.Write([]byte(`{"state":"active"}`))
+				case request.URL.Path == "/user/memberships/orgs/deathbots":
+					writer.Write([]byte(`{"state":"pending"}`))
+				case request.URL.Path == "/orgs/billandted/teams/wyld-stallyns/repos":
+					writer.Write([]byte(teamRepositories))
+				case request.URL.Path == "/orgs/deathbots/teams/evil-robot-us/repos":
+					writer.Write([]byte(`[{"full_name":"deathbots/bogusjourney"}]`))
+				default:
+					writer.WriteHeader(404)
+				}
+			}))
+
+			os.Setenv("GITHUB_CLIENT_ID", "wyld")
+			os.Setenv("GITHUB_CLIENT_SECRET", "shh")
+			os.Setenv("GITHUB_TOKEN_KEY", TestGithubTokenKey)
+			os.Setenv("GITHUB_OAUTH_URL", fakeGithub.URL)
+			os.Setenv("GITHUB_API_URL", fakeGithub.URL)
+			goji.DefaultMux = web.New()
+			director, _ = server.SetupRoutes(TestDatabaseName, apnsCommunicator, apiCommunicator)
+
+			userKey = registerUser("ted")
+		})
+
+		AfterEach(func() {
+			fakeGithub.Close()
+			for _, name := range []string{"GITHUB_CLIENT_ID", "GITHUB_CLIENT_SECRET", "GITHUB_TOKEN_KEY", "GITHUB_OAUTH_URL", "GITHUB_API_URL"} {
+				os.Unsetenv(name)
+			}
+		})
+
+		startAuthorization := func() *url.URL {
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, userRequest("POST", "/users/ted/github", userKey, nil))
+			Expect(responseRecorder.Code).To(Equal(201))
+
+			var authorization server.GithubAuthorization
+			Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &authorization)).To(Succeed())
+			authorizeUrl, err := url.Parse(authorization.Url)
+			Expect(err).NotTo(HaveOccurred())
+			return authorizeUrl
+		}
+
+		signIn := func() {
+			state := startAuthorization().Query().Get("state")
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, NewRequest("GET", "/auth/github/callback?code=c0de&state="+state))
+			Expect(responseRecorder.Code).To(Equal(200))
+		}
+
+		It("sends the user to GitHub to authorize.", func() {
+			authorizeUrl := startAuthorization()
+			Expect(authorizeUrl.Scheme + "://" + authorizeUrl.Host).To(Equal(fakeGithub.URL))
+			Expect(authorizeUrl.Path).To(Equal("/login/oauth/authorize"))
+			Expect(authorizeUrl.Query().Get("client_id")).To(Equal("wyld"))
+			Expect(authorizeUrl.Query().Get("state")).NotTo(BeEmpty())
+
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder,
+				NewRequest("GET", "/auth/github/authorize?state="+authorizeUrl.Query().Get("state")))
+			Expect(responseRecorder.Code).To(Equal(302))
+			Expect(responseRecorder.Header().Get("Location")).To(Equal(authorizeUrl.String()))
+		})
+
+		It("links the GitHub login to the user on callback.", func() {
+			state := startAuthorization().Query().Get("state")
+
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, NewRequest("GET", "/auth/github/callback?code=c0de&state="+state))
+			Expect(responseRecorder.Code).To(Equal(200))
+			Expect(responseRecorder.Body.String()).To(MatchJSON(`{"UserId":"ted","GithubLogin":"theodore"}`))
+			Expect(apiCommunicator.DoUrls).To(Equal([]string{
+				fakeGithub.URL + "/login/oauth/access_token",
+				fakeGithub.URL + "/user",
+			}))
+
+			var user server.UserDocument
+			Expect(db.C("users").FindId("ted").One(&user)).To(Succeed())
+			Expect(user.GithubLogin).To(Equal("theodore"))
+			Expect(user.GithubToken).To(HavePrefix("sealed:"))
+			Expect(user.GithubToken).NotTo(ContainSubstring("gho_excellent"))
+		})
+
+		It("seals GitHub tokens that were stored in plain text.", func() {
+			Expect(db.C("users").UpdateId("ted", bson.M{"$set": bson.M{"githublogin": "theodore", "githubtoken": "gho_excellent"}})).To(Succeed())
+
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder,
+				userRequest("POST", "/users/ted/repositories", userKey, struct{ Name string }{"billandted/excellentadventure"}))
+			Expect(responseRecorder.Code).To(Equal(201))
+
+			var user server.UserDocument
+			Expect(db.C("users").FindId("ted").One(&user)).To(Succeed())
+			Expect(user.GithubToken).To(HavePrefix("sealed:"))
+		})
+
+		It("will not start without a key to seal GitHub tokens with.", func() {
+			os.Unsetenv("GITHUB_TOKEN_KEY")
+			goji.DefaultMux = web.New()
+			_, err := server.SetupRoutes(TestDatabaseName, apnsCommunicator, apiCommunicator)
+			Expect(err).To(MatchError("GITHUB_TOKEN_KEY must be 64 hex characters when sign in with GitHub is configured."))
+		})
+
+		It("only sends the trace context to internal hosts.", func() {
+			callback := func() {
+				request := NewRequest("GET", "/auth/github/callback?code=c0de&state="+startAuthorization().Query().Get("state"))
+				request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(200))
+			}
+
+			callback()
+			Expect(traceparents).To(Equal([]string{"", ""}))
+
+			os.Setenv("TRACE_PROPAGATION_HOSTS", "127.0.0.1")
+			defer os.Unsetenv("TRACE_PROPAGATION_HOSTS")
+			goji.DefaultMux = web.New()
+			server.SetupRoutes(TestDatabaseName, apnsCommunicator, apiCommunicator)
+			traceparents = nil
+			callback()
+			Expect(traceparents).To(HaveLen(2))
+			Expect(traceparents[0]).To(HavePrefix("00-4bf92f3577b34da6a3ce929d0e0e4736-"))
+		})
+
+		It("will only accept a sign in state once.", func() {
+			state := startAuthorization().Query().Get("state")
+			goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), NewRequest("GET", "/auth/github/callback?code=c0de&state="+state))
+
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, NewRequest("GET", "/auth/github/callback?code=c0de&state="+state))
+			Expect(responseRecorder.Code).To(Equal(400))
+			Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"validation_failed","Message":"The GitHub sign in has expired or was already used.","Error":"The GitHub sign in has expired or was already used."}`))
+		})
+
+		It("refuses subscriptions to repositories the GitHub account can not see.", func() {
+			signIn()
+
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder,
+				userRequest("POST", "/users/ted/repositories", userKey, struct{ Name string }{"billandted/excellentadventure"}))
+			Expect(responseRecorder.Code).To(Equal(201))
+
+			responseRecorder = httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder,
+				userRequest("POST", "/users/ted/repositories", userKey, struct{ Name string }{"rufus/time-machine"}))
+			Expect(responseRecorder.Code).To(Equal(403))
+			Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"forbidden","Message":"The linked GitHub account can not see this repository.","Error":"The linked GitHub account can not see this repository."}`))
+		})
+
+		It("refuses device subscriptions to repositories the GitHub account of its user can not see.", func() {
+			signIn()
+			registerDevice(deviceToken("phonebooth"))
+			attachRequest := userRequest("POST", "/users/ted/devices", userKey,
+				server.DeviceCredentials{DeviceId: deviceToken("phonebooth"), Key: deviceKeys[deviceToken("phonebooth")]})
+			goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), attachRequest)
+
+			request, _ := NewPOSTRequestWithJSON("/devices/"+deviceToken("phonebooth")+"/repositories", struct{ Name string }{"rufus/time-machine"})
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceToken("phonebooth")))
+			Expect(responseRecorder.Code).To(Equal(403))
+		})
+
+		It("only accepts subscriptions to owners the GitHub account belongs to.", func() {
+			signIn()
+
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder,
+				userRequest("POST", "/users/ted/repositories", userKey, server.SubscriptionMessage{Name: "billandted/*"}))
+			Expect(responseRecorder.Code).To(Equal(201))
+
+			responseRecorder = httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder,
+				userRequest("POST", "/users/ted/repositories", userKey, server.SubscriptionMessage{Name: "theodore/*"}))
+			Expect(responseRecorder.Code).To(Equal(201))
+
+			responseRecorder = httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder,
+				userRequest("POST", "/users/ted/repositories", userKey, server.SubscriptionMessage{Name: "rufus/*"}))
+			Expect(responseRecorder.Code).To(Equal(403))
+		})
+
+		It("only accepts subscriptions to organisations whose invitation was accepted.", func() {
+			signIn()
+
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder,
+				userRequest("POST", "/users/ted/repositories", userKey, server.SubscriptionMessage{Name: "deathbots/*"}))
+			Expect(responseRecorder.Code).To(Equal(403))
+
+			responseRecorder = httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder,
+				userRequest("POST", "/users/ted/repositories", userKey, server.SubscriptionMessage{Name: "@deathbots/evil-robot-us"}))
+			Expect(responseRecorder.Code).To(Equal(403))
+		})
+
+		It("notifies subscribers of a team of the repositories of the team.", func() {
+			signIn()
+			registerDevice(deviceToken("phonebooth"))
+			goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), userRequest("POST", "/users/ted/devices", userKey,
+				server.DeviceCredentials{DeviceId: deviceToken("phonebooth"), Key: deviceKeys[deviceToken("phonebooth")]}))
+
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder,
+				userRequest("POST", "/users/ted/repositories", userKey, server.SubscriptionMessage{Name: "@billandted/wyld-stallyns"}))
+			Expect(responseRecorder.Code).To(Equal(201))
+
+			responseRecorder = httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, userRequest("GET", "/users/ted/repositories", userKey, nil))
+			Expect(responseRecorder.Body.String()).To(MatchJSON(
+				`[{"Name":"@billandted/wyld-stallyns","Repositories":["billandted/excellentadventure"]}]`))
+
+			apnsClient.Response = &apns.PushNotificationResponse{}
+			request, _ := NewPOSTRequestWithJSON("/hooks/github",
+				`{"name":"billandted/excellentadventure","context":"","state":"failure","description":"Bogus!","branches":[{"Name":"master"}]}`)
+			goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), request)
+			Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
+			Expect(apnsClient.NotificationsSent[0].DeviceToken).To(Equal(deviceToken("phonebooth")))
+		})
+
+		It("refreshes the repositories of subscribed teams.", func() {
+			signIn()
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder,
+				userRequest("POST", "/users/ted/repositories", userKey, server.SubscriptionMessage{Name: "@billandted/wyld-stallyns"}))
+			Expect(responseRecorder.Code).To(Equal(201))
+
+			teamRepositories = `[{"full_name":"billandted/bogusjourney"}]`
+			Expect(director.RefreshTeams(context.Background())).To(Succeed())
+
+			responseRecorder = httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, userRequest("GET", "/users/ted/repositories", userKey, nil))
+			Expect(responseRecorder.Body.String()).To(MatchJSON(
+				`[{"Name":"@billandted/wyld-stallyns","Repositories":["billandted/bogusjourney"]}]`))
+
+			Expect(db.C("users").UpdateId("ted", bson.M{"$unset": bson.M{"githubtoken": ""}})).To(Succeed())
+			Expect(director.RefreshTeams(context.Background())).To(Succeed())
+
+			var team server.RepositoryDocument
+			Expect(db.C("repositories").FindId("@billandted/wyld-stallyns").One(&team)).To(Succeed())
+			Expect(team.Repositories).To(BeEmpty())
+		})
+
+		It("refuses subscriptions to teams the GitHub account can not see.", func() {
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder,
+				userRequest("POST", "/users/ted/repositories", userKey, server.SubscriptionMessage{Name: "@billandted/wyld-stallyns"}))
+			Expect(responseRecorder.Code).To(Equal(400))
+			Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"validation_failed","Message":"Team subscriptions need a user with a linked GitHub account.","Error":"Team subscriptions need a user with a linked GitHub account."}`))
+
+			signIn()
+			responseRecorder = httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder,
+				userRequest("POST", "/users/ted/repositories", userKey, server.SubscriptionMessage{Name: "@rufus/circuits"}))
+			Expect(responseRecorder.Code).To(Equal(403))
+		})
+	})
+
 	Describe("/hooks", func() {
 		Describe("/github", func() {
-			deviceId := "MotherBox"
+			deviceId := deviceToken("MotherBox")
 			repositoryName := "apokalypse/anti-life"
 
 			Describe("when the device is registered on that repository", func() {
 				BeforeEach(func() {
-					post("/devices/"+deviceId+"/repositories", struct{ Name string }{repositoryName})
+					subscribe(deviceId, repositoryName)
 				})
 
 				It("when this state is failure will always notify a device of new state.", func() {
@@ -494,7 +1857,7 @@ var _ = Describe("Endpoint", func() {
 					responseRecorder := httptest.NewRecorder()
 					goji.DefaultMux.ServeHTTP(responseRecorder, request)
 					Expect(responseRecorder.Code).To(Equal(200))
-					Expect(responseRecorder.Body.String()).To(Equal("Accepted."))
+					Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Message":"Accepted."}`))
 
 					Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
 					expectedPayload := `{"aps" : {"alert":"apokalypse/anti-life: Fun!", "badge" : -1}}`
@@ -512,7 +1875,7 @@ var _ = Describe("Endpoint", func() {
 					responseRecorder := httptest.NewRecorder()
 					goji.DefaultMux.ServeHTTP(responseRecorder, request)
 					Expect(responseRecorder.Code).To(Equal(200))
-					Expect(responseRecorder.Body.String()).To(Equal("Accepted."))
+					Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Message":"Accepted."}`))
 
 					Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
 					expectedPayload := `{"aps" : {"alert":"apokalypse/anti-life: Fun!", "badge" : -1}}`
@@ -532,7 +1895,7 @@ var _ = Describe("Endpoint", func() {
 					responseRecorder := httptest.NewRecorder()
 					goji.DefaultMux.ServeHTTP(responseRecorder, request)
 					Expect(responseRecorder.Code).To(Equal(200))
-					Expect(responseRecorder.Body.String()).To(Equal("Accepted."))
+					Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Message":"Accepted."}`))
 
 					Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
 					expectedPayload := `{"aps" : {"alert":"apokalypse/anti-life: Fun!", "badge" : -1}}`
@@ -551,7 +1914,7 @@ var _ = Describe("Endpoint", func() {
 					responseRecorder := httptest.NewRecorder()
 					goji.DefaultMux.ServeHTTP(responseRecorder, request)
 					Expect(responseRecorder.Code).To(Equal(200))
-					Expect(responseRecorder.Body.String()).To(Equal("Accepted."))
+					Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Message":"Accepted."}`))
 
 					Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
 					expectedPayload := `{"aps" : {"alert":"apokalypse/anti-life: Fun!", "badge" : -1}}`
@@ -569,7 +1932,7 @@ var _ = Describe("Endpoint", func() {
 					responseRecorder := httptest.NewRecorder()
 					goji.DefaultMux.ServeHTTP(responseRecorder, request)
 					Expect(responseRecorder.Code).To(Equal(200))
-					Expect(responseRecorder.Body.String()).To(Equal("Accepted."))
+					Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Message":"Accepted."}`))
 
 					Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
 				})
@@ -587,7 +1950,7 @@ var _ = Describe("Endpoint", func() {
 					responseRecorder := httptest.NewRecorder()
 					goji.DefaultMux.ServeHTTP(responseRecorder, request)
 					Expect(responseRecorder.Code).To(Equal(200))
-					Expect(responseRecorder.Body.String()).To(Equal("Accepted."))
+					Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Message":"Accepted."}`))
 
 					Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
 					expectedPayload := `{"aps" : {"alert":"apokalypse/anti-life: Fun!", "badge" : -1}}`
@@ -607,7 +1970,7 @@ var _ = Describe("Endpoint", func() {
 					responseRecorder := httptest.NewRecorder()
 					goji.DefaultMux.ServeHTTP(responseRecorder, request)
 					Expect(responseRecorder.Code).To(Equal(200))
-					Expect(responseRecorder.Body.String()).To(Equal("Accepted."))
+					Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Message":"Accepted."}`))
 
 					Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
 					expectedPayload := `{"aps" : {"alert":"apokalypse/anti-life: Fun!", "badge" : -1}}`
@@ -625,7 +1988,7 @@ var _ = Describe("Endpoint", func() {
 					responseRecorder := httptest.NewRecorder()
 					goji.DefaultMux.ServeHTTP(responseRecorder, request)
 					Expect(responseRecorder.Code).To(Equal(400))
-					Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Error":"Did not recieve a valid branch in Github status."}`))
+					Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"validation_failed","Message":"Did not recieve a valid branch in Github status.","Error":"Did not recieve a valid branch in Github status."}`))
 				})
 
 				It("when there was a success more recently than the failure will not notify a device of new state.", func() {
@@ -640,7 +2003,7 @@ var _ = Describe("Endpoint", func() {
 					responseRecorder := httptest.NewRecorder()
 					goji.DefaultMux.ServeHTTP(responseRecorder, request)
 					Expect(responseRecorder.Code).To(Equal(200))
-					Expect(responseRecorder.Body.String()).To(Equal("Accepted."))
+					Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Message":"Accepted."}`))
 
 					Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
 				})
@@ -656,28 +2019,747 @@ var _ = Describe("Endpoint", func() {
 					responseRecorder := httptest.NewRecorder()
 					goji.DefaultMux.ServeHTTP(responseRecorder, request)
 					Expect(responseRecorder.Code).To(Equal(200))
-					Expect(responseRecorder.Body.String()).To(Equal("Accepted."))
+					Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Message":"Accepted."}`))
 
 					Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
 				})
 
-				It("when github is not available errors are handled.", func() {
+				It("when the same delivery is sent twice will only notify a device once.", func() {
 					apnsClient.Response = &apns.PushNotificationResponse{}
+					apiCommunicator.SetResponse("", 200, `[{"state":"success"}]`)
+
+					for i := 0; i < 2; i++ {
+						request, _ := NewPOSTRequestWithJSON("/hooks/github",
+							`{"name":"apokalypse/anti-life","context":"","state":"failure","description":"Fun!","branches":[{"Name":"master"}]}`)
+						request.Header.Set("X-GitHub-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+
+						responseRecorder := httptest.NewRecorder()
+						goji.DefaultMux.ServeHTTP(responseRecorder, request)
+						Expect(responseRecorder.Code).To(Equal(200))
+						Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Message":"Accepted."}`))
+					}
+
+					Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
+				})
+
+				It("only reads the delivery header of the provider.", func() {
+					apnsClient.Response = &apns.PushNotificationResponse{}
+					apiCommunicator.SetResponse("", 200, `[{"state":"success"}]`)
+
+					for i := 0; i < 2; i++ {
+						request, _ := NewPOSTRequestWithJSON("/hooks/github",
+							`{"name":"apokalypse/anti-life","context":"","state":"failure","description":"Fun!","branches":[{"Name":"master"}]}`)
+						request.Header.Set("X-GitHub-Delivery", fmt.Sprintf("delivery-%v", i))
+						request.Header.Set("X-Request-UUID", "same-uuid")
+						goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), request)
+					}
+
+					Expect(len(apnsClient.NotificationsSent)).To(Equal(2))
+				})
+
+				It("can change how long deliveries are remembered.", func() {
+					os.Setenv("DELIVERY_TTL", "1h")
+					defer os.Unsetenv("DELIVERY_TTL")
+					goji.DefaultMux = web.New()
+					_, err := server.SetupRoutes(TestDatabaseName, apnsCommunicator, apiCommunicator)
+					Expect(err).NotTo(HaveOccurred())
+
+					indexes, err := db.C("deliveries").Indexes()
+					Expect(err).NotTo(HaveOccurred())
+					var expiry time.Duration
+					for _, index := range indexes {
+						if len(index.Key) == 1 && index.Key[0] == "receivedat" {
+							expiry = index.ExpireAfter
+						}
+					}
+					Expect(expiry).To(Equal(time.Hour))
+				})
 
+				It("when a delivery failed it can be retried.", func() {
+					apnsClient.Response = &apns.PushNotificationResponse{}
 					apiCommunicator.ResponseMap[""].Err = errors.New("OH NO")
 
 					request, _ := NewPOSTRequestWithJSON("/hooks/github",
 						`{"name":"apokalypse/anti-life","context":"","state":"success","description":"Fun!","branches":[{"Name":"master"}]}`)
+					request.Header.Set("X-GitHub-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
 					responseRecorder := httptest.NewRecorder()
 					goji.DefaultMux.ServeHTTP(responseRecorder, request)
-					Expect(responseRecorder.Code).To(Equal(500))
-					Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Error":"OH NO"}`))
+					Expect(responseRecorder.Code).To(Equal(502))
+
+					apiCommunicator.ResponseMap[""].Err = nil
+					apiCommunicator.SetResponse("", 200, `[]`)
+					apiCommunicator.SetResponse("https://api.github.com/repos/apokalypse/anti-life/commits/master^/statuses",
+						200, `[{"state":"failure"}]`)
+
+					request, _ = NewPOSTRequestWithJSON("/hooks/github",
+						`{"name":"apokalypse/anti-life","context":"","state":"success","description":"Fun!","branches":[{"Name":"master"}]}`)
+					request.Header.Set("X-GitHub-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+					responseRecorder = httptest.NewRecorder()
+					goji.DefaultMux.ServeHTTP(responseRecorder, request)
+					Expect(responseRecorder.Code).To(Equal(200))
+					Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
+				})
+
+				It("when the status is older than the allowed window will reject it.", func() {
+					apnsClient.Response = &apns.PushNotificationResponse{}
+					apiCommunicator.SetResponse("", 200, `[{"state":"success"}]`)
+
+					request, _ := NewPOSTRequestWithJSON("/hooks/github",
+						`{"name":"apokalypse/anti-life","context":"","state":"failure","description":"Fun!","branches":[{"Name":"master"}],"updated_at":"2012-07-20T01:19:13Z"}`)
 
+					responseRecorder := httptest.NewRecorder()
+					goji.DefaultMux.ServeHTTP(responseRecorder, request)
+					Expect(responseRecorder.Code).To(Equal(400))
+					Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"validation_failed","Message":"Webhook delivery is too old to be accepted.","Error":"Webhook delivery is too old to be accepted."}`))
 					Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
-					Expect(len(apiCommunicator.GetUrls)).To(Equal(1))
-					Expect(apiCommunicator.GetUrls[0]).To(Equal("https://api.github.com/repos/apokalypse/anti-life/commits/master/statuses"))
 				})
-			})
+
+				It("when asked for a dry run explains an old status too.", func() {
+					apnsClient.Response = &apns.PushNotificationResponse{}
+					apiCommunicator.SetResponse("", 200, `[{"state":"success"}]`)
+
+					request, _ := NewPOSTRequestWithJSON("/hooks/github?dryRun=true",
+						`{"name":"apokalypse/anti-life","context":"","state":"failure","description":"Fun!","branches":[{"Name":"master"}],"updated_at":"2012-07-20T01:19:13Z"}`)
+					request.Header.Set("Authorization", "Bearer "+TestAdminToken)
+
+					responseRecorder := httptest.NewRecorder()
+					goji.DefaultMux.ServeHTTP(responseRecorder, request)
+					Expect(responseRecorder.Code).To(Equal(200))
+					Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+				})
+
+				It("rejects bodies larger than a megabyte.", func() {
+					request, _ := NewPOSTRequestWithJSON("/hooks/github", `{"name":"`+strings.Repeat("a", server.WebhookMaxBodyBytes)+`"}`)
+
+					responseRecorder := httptest.NewRecorder()
+					goji.DefaultMux.ServeHTTP(responseRecorder, request)
+					Expect(responseRecorder.Code).To(Equal(413))
+				})
+
+				It("when asked for a dry run explains the decision without notifying.", func() {
+					apnsClient.Response = &apns.PushNotificationResponse{}
+					apiCommunicator.SetResponse("", 200, `[]`)
+					apiCommunicator.SetResponse("https://api.github.com/repos/apokalypse/anti-life/commits/master^/statuses",
+						200, `[{"state":"failure"}]`)
+
+					request, _ := NewPOSTRequestWithJSON("/hooks/github?dryRun=true",
+						`{"name":"apokalypse/anti-life","context":"","state":"success","description":"Fun!","branches":[{"Name":"master"}]}`)
+					request.Header.Set("Authorization", "Bearer "+TestAdminToken)
+
+					responseRecorder := httptest.NewRecorder()
+					goji.DefaultMux.ServeHTTP(responseRecorder, request)
+					Expect(responseRecorder.Code).To(Equal(200))
+
+					var decision server.NotificationDecision
+					Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &decision)).To(Succeed())
+					Expect(decision.Notify).To(BeTrue())
+					Expect(decision.Rule).To(Equal("failure-in-previous-commit"))
+					Expect(decision.Reason).To(Equal("First success after a failure in the previous commit."))
+					Expect(decision.Statuses).To(HaveLen(2))
+					Expect(decision.Statuses["https://api.github.com/repos/apokalypse/anti-life/commits/master^/statuses"][0].State).To(Equal("failure"))
+					Expect(decision.Devices).To(Equal([]string{deviceId}))
+					Expect(decision.Payload.Alert).To(Equal("apokalypse/anti-life: Fun!"))
+
+					Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+				})
+
+				It("when asked for a dry run requires admin credentials.", func() {
+					request, _ := NewPOSTRequestWithJSON("/hooks/github?dryRun=true",
+						`{"name":"apokalypse/anti-life","context":"","state":"failure","description":"Fun!","branches":[{"Name":"master"}]}`)
+
+					responseRecorder := httptest.NewRecorder()
+					goji.DefaultMux.ServeHTTP(responseRecorder, request)
+					Expect(responseRecorder.Code).To(Equal(401))
+					Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+				})
+
+				It("when github answers with an error the request fails.", func() {
+					apnsClient.Response = &apns.PushNotificationResponse{}
+					apiCommunicator.SetResponse("https://api.github.com/repos/apokalypse/anti-life/commits/master/statuses", 500, `[]`)
+
+					request, _ := NewPOSTRequestWithJSON("/hooks/github",
+						`{"name":"apokalypse/anti-life","context":"","state":"success","description":"Fun!","branches":[{"Name":"master"}]}`)
+					responseRecorder := httptest.NewRecorder()
+					goji.DefaultMux.ServeHTTP(responseRecorder, request)
+					Expect(responseRecorder.Code).To(Equal(502))
+					Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+				})
+
+				It("when github is not available errors are handled.", func() {
+					apnsClient.Response = &apns.PushNotificationResponse{}
+					apiCommunicator.DoUrls = nil
+
+					apiCommunicator.ResponseMap[""].Err = errors.New("OH NO")
+
+					request, _ := NewPOSTRequestWithJSON("/hooks/github",
+						`{"name":"apokalypse/anti-life","context":"","state":"success","description":"Fun!","branches":[{"Name":"master"}]}`)
+					responseRecorder := httptest.NewRecorder()
+					goji.DefaultMux.ServeHTTP(responseRecorder, request)
+					Expect(responseRecorder.Code).To(Equal(502))
+					Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"upstream_failed","Message":"The GitHub API request failed.","Error":"The GitHub API request failed.","Details":["OH NO"]}`))
+
+					Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+					Expect(apiCommunicator.DoUrls).To(Equal([]string{"https://api.github.com/repos/apokalypse/anti-life/commits/master/statuses"}))
+				})
+			})
+
+			Describe("when a build fails over and over", func() {
+				BeforeEach(func() {
+					subscribe(deviceId, repositoryName)
+					apnsClient.Response = &apns.PushNotificationResponse{}
+				})
+
+				fail := func() {
+					request, _ := NewPOSTRequestWithJSON("/hooks/github",
+						`{"name":"apokalypse/anti-life","context":"","state":"failure","description":"Fun!","branches":[{"Name":"master"}]}`)
+					goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), request)
+				}
+
+				It("will only notify the device a few times in a window and count the rest.", func() {
+					for i := 0; i < 7; i++ {
+						fail()
+					}
+					Expect(len(apnsClient.NotificationsSent)).To(Equal(5))
+
+					Expect(db.C("throttles").UpdateId(deviceId+"|"+repositoryName,
+						bson.M{"$set": bson.M{"windowstart": time.Now().Add(-time.Hour)}})).To(Succeed())
+					fail()
+					Expect(len(apnsClient.NotificationsSent)).To(Equal(6))
+					expectedPayload := `{"aps" : {"alert":"apokalypse/anti-life: Fun! (and 2 more notifications)", "badge" : -1}}`
+					Expect(apnsClient.NotificationsSent[5].PayloadJSON()).To(MatchJSON(expectedPayload))
+
+					fail()
+					expectedPayload = `{"aps" : {"alert":"apokalypse/anti-life: Fun!", "badge" : -1}}`
+					Expect(apnsClient.NotificationsSent[6].PayloadJSON()).To(MatchJSON(expectedPayload))
+				})
+
+				It("will not count a push as suppressed when another one opened the window at once.", func() {
+					goji.DefaultMux = web.New()
+					director, err := server.SetupRoutes(TestDatabaseName, apnsCommunicator, apiCommunicator)
+					Expect(err).NotTo(HaveOccurred())
+
+					allowed := make(chan bool, 2)
+					for i := 0; i < 2; i++ {
+						go func() {
+							defer GinkgoRecover()
+							store := director.Store()
+							defer store.Close()
+							taken, _, err := store.TakePush(deviceId, "apokalypse/omega", 5, time.Minute)
+							Expect(err).NotTo(HaveOccurred())
+							allowed <- taken
+						}()
+					}
+					Expect([]bool{<-allowed, <-allowed}).To(Equal([]bool{true, true}))
+				})
+
+				It("forgets windows a day after they started.", func() {
+					goji.DefaultMux = web.New()
+					_, err := server.SetupRoutes(TestDatabaseName, apnsCommunicator, apiCommunicator)
+					Expect(err).NotTo(HaveOccurred())
+
+					indexes, err := db.C("throttles").Indexes()
+					Expect(err).NotTo(HaveOccurred())
+					var expiry time.Duration
+					for _, index := range indexes {
+						if len(index.Key) == 1 && index.Key[0] == "windowstart" {
+							expiry = index.ExpireAfter
+						}
+					}
+					Expect(expiry).To(Equal(24 * time.Hour))
+				})
+
+				It("will throttle each repository separately.", func() {
+					for i := 0; i < 6; i++ {
+						fail()
+					}
+					subscribe(deviceId, "apokalypse/mother-box")
+					request, _ := NewPOSTRequestWithJSON("/hooks/github",
+						`{"name":"apokalypse/mother-box","context":"","state":"failure","description":"Boom!","branches":[{"Name":"master"}]}`)
+					goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), request)
+
+					Expect(len(apnsClient.NotificationsSent)).To(Equal(6))
+				})
+			})
+
+			Describe("when the device is registered on the owner of that repository", func() {
+				BeforeEach(func() {
+					linkGithubAccount(deviceId, "darkseid", "apokalypse")
+					subscribe(deviceId, "apokalypse/*")
+					apnsClient.Response = &apns.PushNotificationResponse{}
+				})
+
+				It("will notify the device of every repository of the owner.", func() {
+					request, _ := NewPOSTRequestWithJSON("/hooks/github",
+						`{"name":"apokalypse/anti-life","context":"","state":"failure","description":"Fun!","branches":[{"Name":"master"}]}`)
+					goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), request)
+
+					Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
+					Expect(apnsClient.NotificationsSent[0].DeviceToken).To(Equal(deviceId))
+				})
+
+				It("will notify the device once when also registered on the repository.", func() {
+					subscribe(deviceId, repositoryName)
+
+					request, _ := NewPOSTRequestWithJSON("/hooks/github",
+						`{"name":"apokalypse/anti-life","context":"","state":"failure","description":"Fun!","branches":[{"Name":"master"}]}`)
+					goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), request)
+
+					Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
+				})
+
+				It("will not notify the device of other owners.", func() {
+					request, _ := NewPOSTRequestWithJSON("/hooks/github",
+						`{"name":"darkseid/anti-life","context":"","state":"failure","description":"Fun!","branches":[{"Name":"master"}]}`)
+					goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), request)
+
+					Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+				})
+			})
+		})
+
+		Describe("/gitlab", func() {
+			deviceId := deviceToken("Zorkmid")
+			repositoryName := "gitlab:frobozz/great-underground-empire"
+
+			NewGitlabRequest := func(event string, token string, body string) *http.Request {
+				request, _ := NewPOSTRequestWithJSON("/hooks/gitlab", body)
+				request.Header.Set("X-Gitlab-Event", event)
+				request.Header.Set("X-Gitlab-Token", token)
+				return request
+			}
+
+			pipelineEvent := func(status string) string {
+				return `{"object_kind":"pipeline","object_attributes":{"id":42,"ref":"master","status":"` + status +
+					`"},"project":{"path_with_namespace":"frobozz/great-underground-empire"}}`
+			}
+
+			BeforeEach(func() {
+				apnsClient.Response = &apns.PushNotificationResponse{}
+				subscribe(deviceId, repositoryName)
+			})
+
+			It("rejects events without the configured token.", func() {
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, NewGitlabRequest("Pipeline Hook", "", pipelineEvent("failed")))
+				Expect(responseRecorder.Code).To(Equal(401))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"unauthorized","Message":"GitLab webhook token is missing or incorrect.","Error":"GitLab webhook token is missing or incorrect."}`))
+
+				responseRecorder = httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, NewGitlabRequest("Pipeline Hook", "grue", pipelineEvent("failed")))
+				Expect(responseRecorder.Code).To(Equal(401))
+
+				Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+			})
+
+			It("rejects events other than pipelines and jobs.", func() {
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, NewGitlabRequest("Push Hook", TestGitlabToken, `{}`))
+				Expect(responseRecorder.Code).To(Equal(400))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"validation_failed","Message":"Only GitLab Pipeline and Job events are supported.","Error":"Only GitLab Pipeline and Job events are supported."}`))
+			})
+
+			It("when a pipeline fails will notify a device.", func() {
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, NewGitlabRequest("Pipeline Hook", TestGitlabToken, pipelineEvent("failed")))
+				Expect(responseRecorder.Code).To(Equal(200))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Message":"Accepted."}`))
+
+				Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
+				expectedPayload := `{"aps" : {"alert":"frobozz/great-underground-empire: Pipeline #42 on master failed.", "badge" : -1}}`
+				Expect(apnsClient.NotificationsSent[0].PayloadJSON()).To(MatchJSON(expectedPayload))
+				Expect(apnsClient.NotificationsSent[0].DeviceToken).To(Equal(deviceId))
+			})
+
+			It("when a job fails will notify a device.", func() {
+				request := NewGitlabRequest("Job Hook", TestGitlabToken,
+					`{"object_kind":"build","ref":"master","build_name":"rspec","build_status":"failed","project":{"path_with_namespace":"frobozz/great-underground-empire"}}`)
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(200))
+
+				Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
+				expectedPayload := `{"aps" : {"alert":"frobozz/great-underground-empire: Job rspec on master failed.", "badge" : -1}}`
+				Expect(apnsClient.NotificationsSent[0].PayloadJSON()).To(MatchJSON(expectedPayload))
+			})
+
+			It("when a pipeline succeeds after a failure will notify a device.", func() {
+				goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), NewGitlabRequest("Pipeline Hook", TestGitlabToken, pipelineEvent("failed")))
+				goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), NewGitlabRequest("Pipeline Hook", TestGitlabToken, pipelineEvent("running")))
+				goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), NewGitlabRequest("Pipeline Hook", TestGitlabToken, pipelineEvent("success")))
+
+				Expect(len(apnsClient.NotificationsSent)).To(Equal(2))
+				expectedPayload := `{"aps" : {"alert":"frobozz/great-underground-empire: Pipeline #42 on master success.", "badge" : -1}}`
+				Expect(apnsClient.NotificationsSent[1].PayloadJSON()).To(MatchJSON(expectedPayload))
+			})
+
+			It("when a pipeline succeeds after a success will not notify a device.", func() {
+				goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), NewGitlabRequest("Pipeline Hook", TestGitlabToken, pipelineEvent("success")))
+				goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), NewGitlabRequest("Pipeline Hook", TestGitlabToken, pipelineEvent("success")))
+
+				Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+			})
+
+			It("when asked for a dry run does not remember the pipeline state.", func() {
+				request := NewGitlabRequest("Pipeline Hook", TestGitlabToken, pipelineEvent("failed"))
+				request.URL.RawQuery = "dryRun=true"
+				request.Header.Set("Authorization", "Bearer "+TestAdminToken)
+
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(200))
+				Expect(responseRecorder.Body.String()).To(ContainSubstring(`"Rule":"failure"`))
+
+				goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), NewGitlabRequest("Pipeline Hook", TestGitlabToken, pipelineEvent("success")))
+				Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+			})
+
+			It("when nobody is subscribed to the project will accept the event.", func() {
+				request := NewGitlabRequest("Pipeline Hook", TestGitlabToken,
+					`{"object_attributes":{"id":1,"ref":"master","status":"failed"},"project":{"path_with_namespace":"frobozz/zork"}}`)
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(200))
+				Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+			})
+		})
+
+		Describe("/bitbucket", func() {
+			deviceId := deviceToken("Klaatu")
+			repositoryName := "bitbucket:gort/barada-nikto"
+
+			signed := func(body string) *http.Request {
+				request, data := NewPOSTRequestWithJSON("/hooks/bitbucket", body)
+				mac := hmac.New(sha256.New, []byte(TestBitbucketSecret))
+				mac.Write(data)
+				request.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+				request.Header.Set("X-Event-Key", "repo:commit_status_updated")
+				return request
+			}
+
+			bitbucketEvent := func(state string, refname string) string {
+				return `{"commit_status":{"key":"pipelines","name":"Pipeline #7","state":"` + state +
+					`","description":"Build ` + state + `","refname":"` + refname + `"},"repository":{"full_name":"gort/barada-nikto"}}`
+			}
+
+			NewBitbucketRequest := func(state string) *http.Request {
+				return signed(bitbucketEvent(state, "master"))
+			}
+
+			BeforeEach(func() {
+				apnsClient.Response = &apns.PushNotificationResponse{}
+				subscribe(deviceId, repositoryName)
+			})
+
+			It("rejects events that are not signed with the secret.", func() {
+				request := NewBitbucketRequest("FAILED")
+				request.Header.Set("X-Hub-Signature", "sha256=00")
+
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(401))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"unauthorized","Message":"Bitbucket webhook signature is missing or incorrect.","Error":"Bitbucket webhook signature is missing or incorrect."}`))
+				Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+			})
+
+			It("rejects events without a refname.", func() {
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, signed(bitbucketEvent("FAILED", "")))
+				Expect(responseRecorder.Code).To(Equal(400))
+				Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+			})
+
+			It("rejects events other than commit statuses.", func() {
+				request := signed(`{}`)
+				request.Header.Set("X-Event-Key", "repo:push")
+
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(400))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"validation_failed","Message":"Only Bitbucket commit status events are supported.","Error":"Only Bitbucket commit status events are supported."}`))
+			})
+
+			It("when a build fails will notify a device.", func() {
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, NewBitbucketRequest("FAILED"))
+				Expect(responseRecorder.Code).To(Equal(200))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Message":"Accepted."}`))
+
+				Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
+				expectedPayload := `{"aps" : {"alert":"gort/barada-nikto: Build FAILED", "badge" : -1}}`
+				Expect(apnsClient.NotificationsSent[0].PayloadJSON()).To(MatchJSON(expectedPayload))
+				Expect(apnsClient.NotificationsSent[0].DeviceToken).To(Equal(deviceId))
+			})
+
+			It("when a build succeeds after a failure will notify a device.", func() {
+				goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), NewBitbucketRequest("FAILED"))
+				goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), NewBitbucketRequest("INPROGRESS"))
+				goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), NewBitbucketRequest("SUCCESSFUL"))
+
+				Expect(len(apnsClient.NotificationsSent)).To(Equal(2))
+				expectedPayload := `{"aps" : {"alert":"gort/barada-nikto: Build SUCCESSFUL", "badge" : -1}}`
+				Expect(apnsClient.NotificationsSent[1].PayloadJSON()).To(MatchJSON(expectedPayload))
+			})
+		})
+
+		Describe("/generic", func() {
+			deviceId := deviceToken("HAL")
+			repositoryName := "generic:discovery-one"
+
+			genericEvent := func(state string) string {
+				return `{"repository":"discovery-one","branch":"master","context":"pod-bay",` +
+					`"state":"` + state + `","description":"Doors ` + state + `","url":"https://ci.example.com/9000"}`
+			}
+
+			NewGenericRequest := func(body string) *http.Request {
+				request, _ := NewPOSTRequestWithJSON("/hooks/generic", body)
+				request.Header.Set("X-Sidewinder-Token", TestGenericToken)
+				return request
+			}
+
+			BeforeEach(func() {
+				apnsClient.Response = &apns.PushNotificationResponse{}
+				subscribe(deviceId, repositoryName)
+			})
+
+			It("rejects events that do not follow the schema.", func() {
+				request := NewGenericRequest(`{"repository":"discovery-one","branch":"master","state":"sorry"}`)
+
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(400))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(
+					`{"Code":"validation_failed","Message":"POST to /hooks/generic must be a JSON with repository, branch and a state of success, failure, error or pending.","Error":"POST to /hooks/generic must be a JSON with repository, branch and a state of success, failure, error or pending."}`))
+				Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+			})
+
+			It("when a build fails will notify a device.", func() {
+				request := NewGenericRequest(genericEvent("failure"))
+
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(200))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Message":"Accepted."}`))
+
+				Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
+				expectedPayload := `{"aps" : {"alert":"discovery-one: Doors failure", "badge" : -1}}`
+				Expect(apnsClient.NotificationsSent[0].PayloadJSON()).To(MatchJSON(expectedPayload))
+				Expect(apnsClient.NotificationsSent[0].DeviceToken).To(Equal(deviceId))
+			})
+
+			It("when a build succeeds without a previous failure will not notify a device.", func() {
+				request := NewGenericRequest(genericEvent("success"))
+
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(200))
+				Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+			})
+
+			It("rejects events without the token.", func() {
+				request := NewGenericRequest(genericEvent("failure"))
+				request.Header.Del("X-Sidewinder-Token")
+
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, request)
+				Expect(responseRecorder.Code).To(Equal(401))
+				Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+			})
+
+			It("will not notify subscribers of other providers.", func() {
+				subscribe(deviceToken("Bowman"), "discovery/one")
+				subscribe(deviceToken("Poole"), "gitlab:discovery/one")
+				goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), NewGenericRequest(
+					`{"repository":"discovery/one","branch":"master","state":"failure","description":"Fake"}`))
+				goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), NewGenericRequest(
+					`{"repository":"gitlab:discovery/one","branch":"master","state":"failure","description":"Fake"}`))
+
+				Expect(len(apnsClient.NotificationsSent)).To(Equal(0))
+			})
+
+			It("when a build succeeds after an error will notify a device.", func() {
+				request := NewGenericRequest(genericEvent("error"))
+				goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), request)
+				request = NewGenericRequest(genericEvent("success"))
+				goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), request)
+
+				Expect(len(apnsClient.NotificationsSent)).To(Equal(2))
+			})
+		})
+	})
+
+	Describe("/admin", func() {
+		Describe("/webhooks", func() {
+			deviceId := deviceToken("Zorkmid")
+			repositoryName := "gitlab:frobozz/great-underground-empire"
+			failedPipeline := `{"object_attributes":{"id":42,"ref":"master","status":"failed"},"project":{"path_with_namespace":"frobozz/great-underground-empire"}}`
+
+			var archivedWebhooks []server.WebhookDocument
+
+			BeforeEach(func() {
+				apnsClient.Response = &apns.PushNotificationResponse{}
+				subscribe(deviceId, repositoryName)
+
+				request, _ := NewPOSTRequestWithJSON("/hooks/gitlab", failedPipeline)
+				request.Header.Set("X-Gitlab-Event", "Pipeline Hook")
+				request.Header.Set("X-Gitlab-Token", TestGitlabToken)
+				goji.DefaultMux.ServeHTTP(httptest.NewRecorder(), request)
+
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, adminRequest("GET", "/admin/webhooks"))
+				Expect(responseRecorder.Code).To(Equal(200))
+				Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &archivedWebhooks)).To(Succeed())
+			})
+
+			It("requires admin credentials.", func() {
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, NewRequest("GET", "/admin/webhooks"))
+				Expect(responseRecorder.Code).To(Equal(401))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"unauthorized","Message":"Admin credentials are missing or incorrect.","Error":"Admin credentials are missing or incorrect."}`))
+			})
+
+			It("lists inbound webhooks with secrets redacted.", func() {
+				Expect(len(archivedWebhooks)).To(Equal(1))
+				Expect(archivedWebhooks[0].Provider).To(Equal("gitlab"))
+				Expect(archivedWebhooks[0].Body).To(Equal(failedPipeline))
+				Expect(archivedWebhooks[0].Headers["X-Gitlab-Event"]).To(Equal([]string{"Pipeline Hook"}))
+				Expect(archivedWebhooks[0].Headers["X-Gitlab-Token"]).To(Equal([]string{"REDACTED"}))
+			})
+
+			It("replays a webhook without notifying anyone.", func() {
+				path := "/admin/webhooks/" + archivedWebhooks[0].Id.Hex() + "/replay"
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, adminRequest("POST", path))
+				Expect(responseRecorder.Code).To(Equal(200))
+
+				var decision server.NotificationDecision
+				Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &decision)).To(Succeed())
+				Expect(decision.Notify).To(BeTrue())
+				Expect(decision.Reason).To(Equal("Build failed."))
+				Expect(decision.Devices).To(Equal([]string{deviceId}))
+				Expect(decision.Payload.Alert).To(Equal("frobozz/great-underground-empire: Pipeline #42 on master failed."))
+
+				Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
+			})
+
+			It("reports unknown webhooks as not found.", func() {
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, adminRequest("POST", "/admin/webhooks/nothere/replay"))
+				Expect(responseRecorder.Code).To(Equal(404))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"not_found","Message":"No archived webhook has that id.","Error":"No archived webhook has that id."}`))
+			})
+		})
+
+		Describe("/accounts", func() {
+			addAdmin := func(name string, role string) *httptest.ResponseRecorder {
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, userRequest("POST", "/admin/accounts", TestAdminToken,
+					struct{ Name, Role string }{name, role}))
+				return responseRecorder
+			}
+
+			It("issues keys that carry the role of the account.", func() {
+				responseRecorder := addAdmin("rufus", "read-only")
+				Expect(responseRecorder.Code).To(Equal(201))
+				var credentials server.AdminCredentials
+				Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &credentials)).To(Succeed())
+				Expect(credentials.Role).To(Equal("read-only"))
+
+				responseRecorder = httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, userRequest("GET", "/admin/devices", credentials.Key, nil))
+				Expect(responseRecorder.Code).To(Equal(200))
+
+				responseRecorder = httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, userRequest("POST", "/admin/devices/"+deviceToken("phonebooth")+"/notifications", credentials.Key, nil))
+				Expect(responseRecorder.Code).To(Equal(403))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"Code":"forbidden","Message":"This requires the operator role.","Error":"This requires the operator role."}`))
+
+				responseRecorder = httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, userRequest("GET", "/admin/accounts", credentials.Key, nil))
+				Expect(responseRecorder.Code).To(Equal(403))
+			})
+
+			It("lists and removes accounts.", func() {
+				Expect(addAdmin("rufus", "operator").Code).To(Equal(201))
+				Expect(addAdmin("rufus", "admin").Code).To(Equal(409))
+
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, adminRequest("GET", "/admin/accounts"))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`[{"Name":"rufus","Role":"operator"}]`))
+
+				responseRecorder = httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, adminRequest("DELETE", "/admin/accounts/rufus"))
+				Expect(responseRecorder.Code).To(Equal(200))
+
+				responseRecorder = httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, adminRequest("DELETE", "/admin/accounts/rufus"))
+				Expect(responseRecorder.Code).To(Equal(404))
+			})
+
+			It("rejects unknown roles.", func() {
+				responseRecorder := addAdmin("rufus", "emperor")
+				Expect(responseRecorder.Code).To(Equal(400))
+			})
+		})
+
+		Describe("/devices and /repositories", func() {
+			BeforeEach(func() {
+				apnsClient.Response = &apns.PushNotificationResponse{}
+				subscribe(deviceToken("phonebooth"), "billandted/excellentadventure")
+				subscribe(deviceToken("walkman"), "billandted/excellentadventure")
+				subscribe(deviceToken("walkman"), "billandted/bogusjourney")
+			})
+
+			It("lists every device.", func() {
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, adminRequest("GET", "/admin/devices"))
+				Expect(responseRecorder.Code).To(Equal(200))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`[{"DeviceId":"` + deviceToken("phonebooth") + `"},{"DeviceId":"` + deviceToken("walkman") + `"}]`))
+			})
+
+			It("lists every repository with its subscriber counts.", func() {
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, adminRequest("GET", "/admin/repositories"))
+				Expect(responseRecorder.Code).To(Equal(200))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`[` +
+					`{"Name":"billandted/bogusjourney","Devices":1,"Users":0},` +
+					`{"Name":"billandted/excellentadventure","Devices":2,"Users":0}]`))
+			})
+
+			It("unsubscribes a device from a repository.", func() {
+				path := "/admin/devices/" + deviceToken("walkman") + "/repositories?name=billandted/excellentadventure"
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, adminRequest("DELETE", path))
+				Expect(responseRecorder.Code).To(Equal(200))
+
+				request := NewRequest("GET", "/devices/"+deviceToken("walkman")+"/repositories")
+				responseRecorder = httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, authorize(request, deviceToken("walkman")))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`[{"Name":"billandted/bogusjourney"}]`))
+
+				responseRecorder = httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, adminRequest("DELETE", path))
+				Expect(responseRecorder.Code).To(Equal(404))
+			})
+
+			It("sends a test push to a device.", func() {
+				responseRecorder := httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, userRequest("POST", "/admin/devices/"+deviceToken("walkman")+"/notifications", TestAdminToken,
+					struct{ Alert string }{"Party on, dudes!"}))
+				Expect(responseRecorder.Code).To(Equal(201))
+				Expect(len(apnsClient.NotificationsSent)).To(Equal(1))
+				Expect(apnsClient.NotificationsSent[0].DeviceToken).To(Equal(deviceToken("walkman")))
+				Expect(apnsClient.NotificationsSent[0].PayloadJSON()).To(MatchJSON(`{"aps":{"alert":"Party on, dudes!","badge":-1}}`))
+
+				responseRecorder = httptest.NewRecorder()
+				goji.DefaultMux.ServeHTTP(responseRecorder, adminRequest("POST", "/admin/devices/"+deviceToken("nobody")+"/notifications"))
+				Expect(responseRecorder.Code).To(Equal(404))
+			})
+		})
+
+		It("protects the store info.", func() {
+			responseRecorder := httptest.NewRecorder()
+			goji.DefaultMux.ServeHTTP(responseRecorder, NewRequest("GET", "/store/info"))
+			Expect(responseRecorder.Code).To(Equal(401))
 		})
 	})
 })
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/zenazn/goji/web"
+	"gopkg.in/mgo.v2"
+)
+
+const (
+	CodeValidation    = "validation_failed"
+	CodeUnauthorized  = "unauthorized"
+	CodeForbidden     = "forbidden"
+	CodeNotFound      = "not_found"
+	CodeNotAcceptable = "not_acceptable"
+	CodeConflict      = "conflict"
+	CodeTooLarge      = "request_too_large"
+	CodeMediaType     = "unsupported_media_type"
+	CodeRateLimited   = "rate_limited"
+	CodeInternal      = "internal"
+	CodeUpstream      = "upstream_failed"
+	CodeUnavailable   = "unavailable"
+)
+
+var NotFoundError = NewNotFoundError("Nothing was found there.")
+var EmptyBodyError = NewValidationError("The request body is empty.")
+var InvalidJsonError = NewValidationError("The request body is not valid JSON.")
+var InternalError = NewApiError(500, CodeInternal, "Something went wrong on the server.")
+
+type ErrorJson struct {
+	Code    string
+	Message string
+	Error   string
+	Details []string `json:",omitempty"`
+}
+
+type ApiError struct {
+	Status int
+	ErrorJson
+}
+
+func (self *ApiError) Error() string {
+	return self.Message
+}
+
+func (self *ApiError) WithDetails(details ...string) *ApiError {
+	return &ApiError{self.Status, ErrorJson{self.Code, self.Message, self.Message, details}}
+}
+
+func NewApiError(status int, code string, message string) *ApiError {
+	return &ApiError{status, ErrorJson{Code: code, Message: message, Error: message}}
+}
+
+func NewValidationError(message string, details ...string) *ApiError {
+	return NewApiError(400, CodeValidation, message).WithDetails(details...)
+}
+
+func NewUnauthorizedError(message string) *ApiError {
+	return NewApiError(401, CodeUnauthorized, message)
+}
+
+func NewForbiddenError(message string) *ApiError {
+	return NewApiError(403, CodeForbidden, message)
+}
+
+func NewNotFoundError(message string) *ApiError {
+	return NewApiError(404, CodeNotFound, message)
+}
+
+func NewConflictError(message string) *ApiError {
+	return NewApiError(409, CodeConflict, message)
+}
+
+func NewUpstreamError(message string, err error) *ApiError {
+	return NewApiError(502, CodeUpstream, message).WithDetails(err.Error())
+}
+
+func NewUnavailableError(message string) *ApiError {
+	return NewApiError(503, CodeUnavailable, message)
+}
+
+func asApiError(err error) *ApiError {
+	switch typed := err.(type) {
+	case *ApiError:
+		return typed
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return InvalidJsonError.WithDetails(err.Error())
+	}
+
+	switch err {
+	case mgo.ErrNotFound:
+		return NotFoundError
+	case io.EOF:
+		return EmptyBodyError
+	case io.ErrUnexpectedEOF:
+		return InvalidJsonError.WithDetails(err.Error())
+	}
+	return InternalError
+}
+
+func writeError(writer http.ResponseWriter, request *http.Request, apiError *ApiError) error {
+	return writeJson(apiError.Status, apiError.ErrorJson, writer, request)
+}
+
+func failRequest(context web.C, writer http.ResponseWriter, request *http.Request, err error) {
+	apiError := asApiError(err)
+	annotate(context, "error_code", apiError.Code)
+	if apiError.Status >= 500 {
+		Log.Error("Request failed.", err, logFields(context))
+	}
+	writeError(writer, request, apiError)
+}
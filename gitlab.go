@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/zenazn/goji/web"
+)
+
+const GitlabProvider = "gitlab"
+
+var GitlabMissingTokenError = NewUnauthorizedError("GitLab webhook token is missing or incorrect.")
+var GitlabUnsupportedEventError = NewValidationError("Only GitLab Pipeline and Job events are supported.")
+var GitlabMissingProjectError = NewValidationError("Did not recieve a valid project and ref in GitLab event.")
+
+type GitlabProject struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+}
+
+type GitlabPipelineEvent struct {
+	ObjectAttributes struct {
+		Id     int
+		Ref    string
+		Status string
+	} `json:"object_attributes"`
+	Project GitlabProject
+}
+
+type GitlabJobEvent struct {
+	Ref         string
+	BuildName   string `json:"build_name"`
+	BuildStatus string `json:"build_status"`
+	Project     GitlabProject
+}
+
+func (self *SidewinderDirector) RequireGitlabToken(handler RestHandler) RestHandler {
+	return func(context web.C, writer http.ResponseWriter, request *http.Request) error {
+		if !self.hasValidGitlabToken(request) {
+			return GitlabMissingTokenError
+		}
+		return handler(context, writer, request)
+	}
+}
+
+func (self *SidewinderDirector) GitlabNotify(context web.C, writer http.ResponseWriter, request *http.Request) error {
+	event, err := decodeGitlabEvent(request)
+	if err != nil {
+		return err
+	} else if event == nil {
+		return GitlabUnsupportedEventError
+	} else if event.Repository == "" || event.Branch == "" {
+		return GitlabMissingProjectError
+	}
+
+	return self.NotifyBuildEvent(context, writer, request, *event)
+}
+
+func (self *SidewinderDirector) hasValidGitlabToken(request *http.Request) bool {
+	token := request.Header.Get("X-Gitlab-Token")
+	if self.GitlabToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(self.GitlabToken)) == 1
+}
+
+func decodeGitlabEvent(request *http.Request) (*BuildEvent, error) {
+	switch request.Header.Get("X-Gitlab-Event") {
+	case "Pipeline Hook":
+		var event GitlabPipelineEvent
+		if decodeErr := json.NewDecoder(request.Body).Decode(&event); decodeErr != nil {
+			return nil, decodeErr
+		}
+		attributes := event.ObjectAttributes
+		return &BuildEvent{
+			Provider:    GitlabProvider,
+			Repository:  event.Project.PathWithNamespace,
+			Branch:      attributes.Ref,
+			Context:     "pipeline",
+			State:       gitlabState(attributes.Status),
+			Description: fmt.Sprintf("Pipeline #%v on %v %v.", attributes.Id, attributes.Ref, attributes.Status),
+		}, nil
+	case "Job Hook":
+		var event GitlabJobEvent
+		if decodeErr := json.NewDecoder(request.Body).Decode(&event); decodeErr != nil {
+			return nil, decodeErr
+		}
+		return &BuildEvent{
+			Provider:    GitlabProvider,
+			Repository:  event.Project.PathWithNamespace,
+			Branch:      event.Ref,
+			Context:     "job/" + event.BuildName,
+			State:       gitlabState(event.BuildStatus),
+			Description: fmt.Sprintf("Job %v on %v %v.", event.BuildName, event.Ref, event.BuildStatus),
+		}, nil
+	default:
+		return nil, nil
+	}
+}
+
+func gitlabState(status string) string {
+	switch status {
+	case "success":
+		return "success"
+	case "failed":
+		return "failure"
+	default:
+		return ""
+	}
+}
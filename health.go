@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/anachronistic/apns"
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	HealthOk          = "ok"
+	HealthUnavailable = "unavailable"
+)
+
+type HealthReport struct {
+	Status string
+	Checks []HealthCheck `json:",omitempty"`
+}
+
+type HealthCheck struct {
+	Name   string
+	Status string
+	Error  string `json:",omitempty"`
+}
+
+func (self *SidewinderDirector) Healthz(context web.C, writer http.ResponseWriter, request *http.Request) error {
+	return writeJson(200, HealthReport{Status: HealthOk}, writer, request)
+}
+
+func (self *SidewinderDirector) Readyz(context web.C, writer http.ResponseWriter, request *http.Request) error {
+	checks := []struct {
+		name  string
+		check func() error
+	}{
+		{"mongo", self.checkMongo},
+		{"apns", self.ApnsCommunicator.Check},
+		{"github", func() error { return self.checkGithub(request.Context()) }},
+		{"pushes", self.checkPushes},
+	}
+
+	results := make([]chan error, len(checks))
+	for index, check := range checks {
+		results[index] = make(chan error, 1)
+		go func(check func() error, result chan error) {
+			result <- check()
+		}(check.check, results[index])
+	}
+
+	report := HealthReport{Status: HealthOk}
+	deadline := time.After(self.ReadyTimeout)
+	for index, check := range checks {
+		var err error
+		select {
+		case err = <-results[index]:
+		case <-deadline:
+			err = fmt.Errorf("Did not finish within %v.", self.ReadyTimeout)
+		}
+
+		healthCheck := HealthCheck{Name: check.name, Status: HealthOk}
+		if err != nil {
+			healthCheck.Status, healthCheck.Error = HealthUnavailable, err.Error()
+			report.Status = HealthUnavailable
+		}
+		report.Checks = append(report.Checks, healthCheck)
+	}
+
+	if report.Status != HealthOk {
+		return writeJson(503, report, writer, request)
+	}
+	return writeJson(200, report, writer, request)
+}
+
+func (self *SidewinderDirector) checkMongo() error {
+	store := self.Store()
+	defer store.Close()
+	return store.session.Ping()
+}
+
+func (self *SidewinderDirector) checkGithub(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, self.ReadyTimeout)
+	defer cancel()
+	request, err := self.githubApiRequest(ctx, "/rate_limit", "")
+	if err != nil {
+		return err
+	}
+	response, err := self.Api(ctx).Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != 200 {
+		return fmt.Errorf("GitHub responded %v.", response.StatusCode)
+	}
+	return nil
+}
+
+func (self *SidewinderDirector) checkPushes() error {
+	if inFlight := atomic.LoadInt32(&self.pushesInFlight); int(inFlight) > self.ReadyMaxPushes {
+		return fmt.Errorf("%v push notifications in flight, more than %v.", inFlight, self.ReadyMaxPushes)
+	}
+	return nil
+}
+
+func (self *APNSCommunicator) Check() error {
+	client := self.MakeClient()
+	if client == nil {
+		return fmt.Errorf("Could not make an APNS client.")
+	}
+	if bareClient, isBare := client.(*apns.Client); isBare && bareClient.CertificateFile == "" {
+		if _, err := tls.X509KeyPair([]byte(bareClient.CertificateBase64), []byte(bareClient.KeyBase64)); err != nil {
+			return fmt.Errorf("APNS_CERTIFICATE and APNS_KEY are not a valid key pair.\n%v", err.Error())
+		}
+	}
+	return nil
+}
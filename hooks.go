@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	GithubProvider      = "github"
+	BitbucketProvider   = "bitbucket"
+	GenericProvider     = "generic"
+	WebhookArchiveBytes = 16 * 1024 * 1024
+	WebhookMaxBodyBytes = 1024 * 1024
+)
+
+var WebhookStaleDeliveryError = NewValidationError("Webhook delivery is too old to be accepted.")
+var BitbucketUnsupportedEventError = NewValidationError("Only Bitbucket commit status events are supported.")
+var BitbucketMissingRepositoryError = NewValidationError("Did not recieve a valid repository and refname in Bitbucket event.")
+var BitbucketMissingSignatureError = NewUnauthorizedError("Bitbucket webhook signature is missing or incorrect.")
+var GenericMissingTokenError = NewUnauthorizedError("Generic webhook token is missing or incorrect.")
+var GenericInvalidEventError = NewValidationError("POST to /hooks/generic must be a JSON with repository, branch and a state of success, failure, error or pending.")
+
+var deliveryHeaders = map[string]string{
+	GithubProvider:    "X-GitHub-Delivery",
+	GitlabProvider:    "X-Gitlab-Event-UUID",
+	BitbucketProvider: "X-Request-UUID",
+}
+
+var redactedHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"X-Gitlab-Token",
+	"X-Hub-Signature",
+	"X-Hub-Signature-256",
+	"X-Sidewinder-Token",
+}
+
+func (self *SidewinderDirector) Webhook(provider string, handler RestHandler) RestHandler {
+	self.webhooks[provider] = handler
+	archived := self.Archived(provider, self.Deduplicated(provider, handler))
+	dryRun := self.RequireRole(RoleOperator, DryRun(handler))
+	return func(context web.C, writer http.ResponseWriter, request *http.Request) error {
+		context = withEnv(context, ProviderKey, provider)
+		if request.URL.Query().Get("dryRun") == "true" {
+			return dryRun(context, writer, request)
+		}
+		return archived(context, writer, request)
+	}
+}
+
+func (self *SidewinderDirector) Archived(provider string, handler RestHandler) RestHandler {
+	return func(context web.C, writer http.ResponseWriter, request *http.Request) error {
+		body, err := readWebhookBody(request)
+		if err != nil {
+			return err
+		}
+
+		webhook := WebhookDocument{bson.NewObjectId(), provider, time.Now(), redactHeaders(request.Header), string(body)}
+		if err := self.StoreWith(request.Context()).ArchiveWebhook(webhook); err != nil {
+			Log.Error("Could not archive webhook.", err, LogFields{"provider": provider})
+		}
+		return handler(context, writer, request)
+	}
+}
+
+func readWebhookBody(request *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, request.Body, WebhookMaxBodyBytes))
+	if _, tooLarge := err.(*http.MaxBytesError); tooLarge {
+		return nil, RequestTooLargeError
+	} else if err != nil {
+		return nil, err
+	}
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+func (self *SidewinderDirector) RequireBitbucketSignature(handler RestHandler) RestHandler {
+	return func(context web.C, writer http.ResponseWriter, request *http.Request) error {
+		body, err := readWebhookBody(request)
+		if err != nil {
+			return err
+		} else if !hasValidSignature(self.BitbucketSecret, request.Header.Get("X-Hub-Signature"), body) {
+			return BitbucketMissingSignatureError
+		}
+		return handler(context, writer, request)
+	}
+}
+
+func hasValidSignature(secret string, signature string, body []byte) bool {
+	if secret == "" || !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	sent, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(sent, mac.Sum(nil))
+}
+
+func (self *SidewinderDirector) RequireGenericToken(handler RestHandler) RestHandler {
+	return func(context web.C, writer http.ResponseWriter, request *http.Request) error {
+		token := request.Header.Get("X-Sidewinder-Token")
+		if self.GenericToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(self.GenericToken)) != 1 {
+			return GenericMissingTokenError
+		}
+		return handler(context, writer, request)
+	}
+}
+
+func redactHeaders(header http.Header) map[string][]string {
+	redacted := make(map[string][]string, len(header))
+	for name, values := range header {
+		redacted[name] = values
+	}
+	for _, name := range redactedHeaders {
+		if _, present := redacted[name]; present {
+			redacted[name] = []string{"REDACTED"}
+		}
+	}
+	return redacted
+}
+
+func webhookDeliveryId(provider string, request *http.Request) string {
+	header, known := deliveryHeaders[provider]
+	if !known {
+		return ""
+	} else if id := request.Header.Get(header); id != "" {
+		return provider + ":" + id
+	}
+	return ""
+}
+
+func (self *SidewinderDirector) Deduplicated(provider string, handler RestHandler) RestHandler {
+	return func(context web.C, writer http.ResponseWriter, request *http.Request) error {
+		deliveryId := webhookDeliveryId(provider, request)
+		if deliveryId == "" {
+			return handler(context, writer, request)
+		}
+
+		isNew, err := self.StoreWith(request.Context()).RecordDelivery(deliveryId)
+		if err != nil {
+			return err
+		} else if !isNew {
+			return writeJson(200, Accepted, writer, request)
+		}
+
+		if err := handler(context, writer, request); err != nil {
+			self.StoreWith(request.Context()).ForgetDelivery(deliveryId)
+			return err
+		}
+		return nil
+	}
+}
+
+func (self *SidewinderDirector) isStale(timestamp time.Time) bool {
+	if timestamp.IsZero() || self.WebhookMaxAge <= 0 {
+		return false
+	}
+	return time.Since(timestamp) > self.WebhookMaxAge
+}
+
+func webhookDocs(summary string, event interface{}) map[string]Operation {
+	return map[string]Operation{
+		"POST": {Summary: summary, Query: []string{"dryRun"}, Request: event, Response: Acknowledgement{}},
+	}
+}
+
+type BitbucketCommitStatusEvent struct {
+	CommitStatus struct {
+		Key         string
+		Name        string
+		State       string
+		Description string
+		Url         string
+		Refname     string
+	} `json:"commit_status"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	}
+}
+
+func (self *SidewinderDirector) BitbucketNotify(context web.C, writer http.ResponseWriter, request *http.Request) error {
+	switch request.Header.Get("X-Event-Key") {
+	case "repo:commit_status_created", "repo:commit_status_updated":
+	default:
+		return BitbucketUnsupportedEventError
+	}
+
+	var notification BitbucketCommitStatusEvent
+	if decodeErr := json.NewDecoder(request.Body).Decode(&notification); decodeErr != nil {
+		return decodeErr
+	}
+	if notification.Repository.FullName == "" || notification.CommitStatus.Refname == "" {
+		return BitbucketMissingRepositoryError
+	}
+
+	return self.NotifyBuildEvent(context, writer, request, notification.BuildEvent())
+}
+
+func (self BitbucketCommitStatusEvent) BuildEvent() BuildEvent {
+	status := self.CommitStatus
+	description := status.Description
+	if description == "" {
+		description = status.Name
+	}
+	return BuildEvent{
+		Provider:    BitbucketProvider,
+		Repository:  self.Repository.FullName,
+		Branch:      status.Refname,
+		Context:     status.Key,
+		State:       bitbucketState(status.State),
+		Description: description,
+		Url:         status.Url,
+	}
+}
+
+func bitbucketState(state string) string {
+	switch state {
+	case "SUCCESSFUL":
+		return "success"
+	case "FAILED":
+		return "failure"
+	case "STOPPED":
+		return "error"
+	default:
+		return "pending"
+	}
+}
+
+func (self *SidewinderDirector) GenericNotify(context web.C, writer http.ResponseWriter, request *http.Request) error {
+	var event BuildEvent
+	if decodeErr := json.NewDecoder(request.Body).Decode(&event); decodeErr != nil || !isValidGenericEvent(event) {
+		return GenericInvalidEventError
+	}
+	event.Provider = GenericProvider
+
+	return self.NotifyBuildEvent(context, writer, request, event)
+}
+
+func isValidGenericEvent(event BuildEvent) bool {
+	if event.Repository == "" || event.Branch == "" {
+		return false
+	}
+	switch event.State {
+	case "success", "failure", "error", "pending":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/anachronistic/apns"
+	"github.com/zenazn/goji/graceful"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func (self *SidewinderDirector) HandleShutdown() {
+	graceful.AddSignal(syscall.SIGTERM)
+	graceful.Timeout(self.ShutdownTimeout)
+	var deadline time.Time
+	graceful.PreHook(func() {
+		deadline = time.Now().Add(self.ShutdownTimeout)
+		Log.Info("Stopping, waiting for requests in flight.", LogFields{"timeout": self.ShutdownTimeout.String()})
+	})
+	graceful.PostHook(func() {
+		if err := self.Close(time.Until(deadline)); err != nil {
+			Log.Error("Could not close.", err, nil)
+		}
+	})
+}
+
+func (self *SidewinderDirector) push(ctx context.Context, deviceId string, payload *apns.Payload) error {
+	_, span := tracer.Start(ctx, "apns send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("apns.device_id", deviceId)))
+	self.pushes.Add(1)
+	atomic.AddInt32(&self.pushesInFlight, 1)
+	defer func() {
+		atomic.AddInt32(&self.pushesInFlight, -1)
+		self.pushes.Done()
+	}()
+	err := self.ApnsCommunicator.sendPushNotification(deviceId, payload)
+	endSpan(span, err)
+	if err != nil {
+		pushDeliveries.WithLabelValues("failed").Inc()
+		return NewUpstreamError("APNS did not accept the push notification.", err)
+	}
+	pushDeliveries.WithLabelValues("sent").Inc()
+	return nil
+}
+
+func (self *SidewinderDirector) Close(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	drained := make(chan struct{})
+	go func() {
+		self.pushes.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		err = fmt.Errorf("Gave up waiting for push notifications after %v.", timeout)
+	}
+	self.session.Close()
+	if tracingErr := self.shutdownTracing(time.Until(deadline)); err == nil {
+		err = tracingErr
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+const (
+	RequestIdHeader = "X-Request-ID"
+	RequestIdKey    = "requestId"
+	LogFieldsKey    = "logFields"
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+var Log = NewLogger(os.Stdout, LevelInfo)
+
+type LogFields map[string]interface{}
+
+type Logger struct {
+	Level  int
+	mutex  sync.Mutex
+	output io.Writer
+}
+
+func NewLogger(output io.Writer, level int) *Logger {
+	return &Logger{Level: level, output: output}
+}
+
+func (self *Logger) SetOutput(output io.Writer) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.output = output
+}
+
+func (self *Logger) Log(level int, message string, fields LogFields) {
+	if level < self.Level {
+		return
+	}
+
+	entry := make(LogFields, len(fields)+3)
+	for key, value := range fields {
+		entry[key] = value
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = levelNames[level]
+	entry["msg"] = message
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	json.NewEncoder(self.output).Encode(entry)
+}
+
+func (self *Logger) Debug(message string, fields LogFields) {
+	self.Log(LevelDebug, message, fields)
+}
+
+func (self *Logger) Info(message string, fields LogFields) {
+	self.Log(LevelInfo, message, fields)
+}
+
+func (self *Logger) Warn(message string, fields LogFields) {
+	self.Log(LevelWarn, message, fields)
+}
+
+func (self *Logger) Error(message string, err error, fields LogFields) {
+	entry := make(LogFields, len(fields)+1)
+	for key, value := range fields {
+		entry[key] = value
+	}
+	entry["error"] = err.Error()
+	self.Log(LevelError, message, entry)
+}
+
+func levelFromEnv(name string, fallback int) (int, error) {
+	value := strings.ToLower(os.Getenv(name))
+	if value == "" {
+		return fallback, nil
+	}
+	for level, levelName := range levelNames {
+		if value == levelName {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("%v must be one of %v.", name, strings.Join(levelNames, ", "))
+}
+
+func RequestId(context *web.C, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requestId := request.Header.Get(RequestIdHeader)
+		if !requestIdPattern.MatchString(requestId) {
+			requestId = newRequestId()
+		}
+
+		if context.Env == nil {
+			context.Env = make(map[interface{}]interface{})
+		}
+		context.Env[RequestIdKey] = requestId
+		context.Env[LogFieldsKey] = LogFields{"request_id": requestId}
+		writer.Header().Set(RequestIdHeader, requestId)
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+func newRequestId() string {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(bytes)
+}
+
+func logFields(context web.C) LogFields {
+	fields, _ := context.Env[LogFieldsKey].(LogFields)
+	if fields == nil {
+		return LogFields{}
+	}
+	return fields
+}
+
+func annotate(context web.C, key string, value interface{}) {
+	if fields, ok := context.Env[LogFieldsKey].(LogFields); ok {
+		fields[key] = value
+	}
+}
@@ -1,18 +1,19 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"os"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/zenazn/goji"
+	"github.com/zenazn/goji/graceful"
 	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
 )
 
-type ErrorJson struct {
-	Error string
-}
-
 func hello(context web.C, w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Ahoy, %s!", context.URLParams["name"])
 }
@@ -20,29 +21,128 @@ func hello(context web.C, w http.ResponseWriter, r *http.Request) {
 func main() {
 	apnsCommunicator := NewAPNSCommunicator()
 	apiCommunicator := HttpCommunicator{}
-	if err := SetupRoutes("SidewinderMain", apnsCommunicator, apiCommunicator); err != nil {
-		fmt.Errorf("Error on launch:\n%v", err.Error())
-		os.Exit(1)
-		return
+	sidewinderDirector, err := SetupRoutes("SidewinderMain", apnsCommunicator, apiCommunicator)
+	if err != nil {
+		exitOnLaunchError(err)
+	}
+
+	sidewinderDirector.HandleShutdown()
+	sidewinderDirector.RefreshTeamsEvery(sidewinderDirector.TeamRefreshInterval)
+	if err := serve(sidewinderDirector.Tls); err != nil {
+		exitOnLaunchError(err)
 	}
-	goji.Serve()
 }
 
-func SetupRoutes(mongoDB string, apnsComs *APNSCommunicator, apiCommunicator ApiCommunicator) error {
-	sidewinderDirector, err := NewSidewinderDirector(mongoDB, apnsComs, apiCommunicator)
+func exitOnLaunchError(err error) {
+	fmt.Fprintf(os.Stderr, "Error on launch:\n%v\n", err.Error())
+	os.Exit(1)
+}
+
+func serve(tlsConfig TlsConfig) error {
+	if !tlsConfig.IsEnabled() {
+		goji.Serve()
+		return nil
+	}
+
+	certificates, err := NewCertificateReloader(tlsConfig.CertFile, tlsConfig.KeyFile)
 	if err != nil {
 		return err
 	}
+	certificates.ReloadOnHangup()
+	if tlsConfig.RedirectAddr != "" {
+		go func() {
+			if err := graceful.ListenAndServe(tlsConfig.RedirectAddr, tlsConfig.RedirectHandler()); err != nil {
+				Log.Error("HTTP redirect stopped.", err, nil)
+			}
+		}()
+	}
+	goji.ServeTLS(&tls.Config{
+		GetCertificate: certificates.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	})
+	return nil
+}
 
-	goji.Get("/hello/:name", hello)
-	goji.Get("/store/info", RestHandler(sidewinderDirector.DatastoreInfo))
+func SetupRoutes(mongoDB string, apnsComs *APNSCommunicator, apiCommunicator ApiCommunicator) (*SidewinderDirector, error) {
+	sidewinderDirector, err := NewSidewinderDirector(mongoDB, apnsComs, apiCommunicator)
+	if err != nil {
+		return nil, err
+	}
 
-	NewRestMux("/devices", goji.DefaultMux).Use(&RestEndpoint{
-		Post: RestHandler(sidewinderDirector.postDevice),
-	}).Handle("/:id", sidewinderDirector.DeviceMux())
+	goji.Abandon(middleware.Logger)
+	goji.Abandon(middleware.RequestID)
+	goji.Use(RequestId)
+	goji.Use(sidewinderDirector.Sessions)
+	goji.Use(Trace)
+	goji.Use(sidewinderDirector.Tls.Hsts)
+	goji.Use(sidewinderDirector.Cors.Middleware)
+	goji.Get("/hello/:name", hello)
+	goji.Get("/healthz", RestHandler(sidewinderDirector.Healthz))
+	goji.Get("/readyz", RestHandler(sidewinderDirector.Readyz))
+	goji.Get("/metrics", promhttp.Handler())
+	sidewinderDirector.MountApi(goji.DefaultMux)
+	return sidewinderDirector, nil
+}
 
-	hooksMux := NewRestMux("/hooks", goji.DefaultMux)
-	hooksMux.Handle("/github", &RestEndpoint{
-		Post: RestHandler(sidewinderDirector.GithubNotify)})
-	return nil
+func (self *SidewinderDirector) ApiV1() *RestEndpoint {
+	return (&RestEndpoint{}).Route("/store/info", RestEndpoint{
+		Get: self.RequireRole(RoleReadOnly, self.DatastoreInfo),
+		Docs: map[string]Operation{
+			"GET": {Summary: "Describe the MongoDB deployment.", Response: DatastoreInfo{}},
+		},
+	}).Route("/devices", RestEndpoint{
+		Post:      RestHandler(self.postDevice),
+		RateLimit: NewRateLimiter(DeviceRegistrationsPerMinute, time.Minute, ByClient),
+		Paths:     map[string]RestEndpoint{"/:id": *self.DeviceMux()},
+		Docs: map[string]Operation{
+			"POST": {Summary: "Register a device.", Status: 201, Request: DeviceDocument{}, Response: DeviceCredentials{}},
+		},
+	}).Route("/users", RestEndpoint{
+		Post:  RestHandler(self.postUser),
+		Paths: map[string]RestEndpoint{"/:id": *self.UserMux()},
+		Docs: map[string]Operation{
+			"POST": {Summary: "Register a user.", Status: 201, Request: UserDocument{}, Response: UserCredentials{}},
+		},
+	}).Route("/auth/github", RestEndpoint{
+		Paths: map[string]RestEndpoint{
+			"/authorize": {
+				Get: RestHandler(self.GithubAuthorize),
+				Docs: map[string]Operation{
+					"GET": {Summary: "Redirect to GitHub to link an account.", Status: 302, Query: []string{"state"}},
+				},
+			},
+			"/callback": {
+				Get: RestHandler(self.GithubCallback),
+				Docs: map[string]Operation{
+					"GET": {Summary: "Finish linking a GitHub account.", Query: []string{"code", "state", "error"}, Response: GithubLink{}},
+				},
+			},
+		},
+	}).Route("/hooks", RestEndpoint{
+		Paths: map[string]RestEndpoint{
+			"/github": {
+				Post: self.Webhook(GithubProvider, self.GithubNotify),
+				Docs: webhookDocs("Receive a GitHub status event.", GithubStatus{}),
+			},
+			"/gitlab": {
+				Post: self.RequireGitlabToken(self.Webhook(GitlabProvider, self.GitlabNotify)),
+				Docs: webhookDocs("Receive a GitLab pipeline or job event.", GitlabPipelineEvent{}),
+			},
+			"/bitbucket": {
+				Post: self.RequireBitbucketSignature(self.Webhook(BitbucketProvider, self.BitbucketNotify)),
+				Docs: webhookDocs("Receive a Bitbucket commit status event.", BitbucketCommitStatusEvent{}),
+			},
+			"/generic": {
+				Post: self.RequireGenericToken(self.Webhook(GenericProvider, self.GenericNotify)),
+				Docs: webhookDocs("Receive a build event from any CI.", BuildEvent{}),
+			},
+		},
+	}).Route("/admin", RestEndpoint{
+		Paths: map[string]RestEndpoint{
+			"/webhooks":     *self.WebhookArchiveMux(),
+			"/devices":      *self.AdminDeviceMux(),
+			"/repositories": *self.AdminRepositoryMux(),
+			"/accounts":     *self.AdminAccountMux(),
+		},
+	})
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/zenazn/goji/web"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sidewinder_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "sidewinder_http_request_duration_seconds",
+		Help: "Time taken to answer HTTP requests by route and method.",
+	}, []string{"route", "method"})
+	webhookEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sidewinder_webhook_events_total",
+		Help: "Build events received by webhook provider and build state.",
+	}, []string{"provider", "state"})
+	pushDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sidewinder_push_deliveries_total",
+		Help: "Push notifications by outcome: sent, failed or throttled.",
+	}, []string{"outcome"})
+	githubRequestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "sidewinder_github_request_duration_seconds",
+		Help: "Time taken by requests to GitHub.",
+	})
+	githubRateLimitRemaining = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sidewinder_github_rate_limit_remaining",
+		Help: "Requests left in the current GitHub API rate limit window.",
+	})
+	mongoOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sidewinder_mongo_operation_duration_seconds",
+		Help:    "Time taken by MongoDB operations of the store.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequests,
+		httpRequestDuration,
+		webhookEvents,
+		pushDeliveries,
+		githubRequestDuration,
+		githubRateLimitRemaining,
+		mongoOperationDuration,
+	)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (self *statusRecorder) WriteHeader(code int) {
+	self.code = code
+	self.ResponseWriter.WriteHeader(code)
+}
+
+func instrument(route string, method string, handler web.Handler) web.Handler {
+	return web.HandlerFunc(func(context web.C, writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		annotate(context, "route", route)
+		annotate(context, "method", method)
+		if deviceId := routeDeviceId(route, context); deviceId != "" {
+			annotate(context, "device_id", deviceId)
+		}
+
+		recorder := &statusRecorder{writer, 200}
+		handler.ServeHTTPC(context, recorder, request)
+		latency := time.Since(start)
+		traceRoute(context, route, method, recorder.code)
+		httpRequests.WithLabelValues(route, method, strconv.Itoa(recorder.code)).Inc()
+		httpRequestDuration.WithLabelValues(route, method).Observe(latency.Seconds())
+
+		fields := logFields(context)
+		fields["status"] = recorder.code
+		fields["latency_ms"] = float64(latency.Nanoseconds()) / float64(time.Millisecond)
+		Log.Info("Request served.", fields)
+	})
+}
+
+func routeDeviceId(route string, context web.C) string {
+	if deviceId := context.URLParams["deviceId"]; deviceId != "" {
+		return deviceId
+	}
+	if strings.Contains(route, "/devices/:id") {
+		return context.URLParams["id"]
+	}
+	return ""
+}
+
+func countWebhookEvent(provider string, state string) {
+	switch state {
+	case "success", "failure", "error", "pending":
+	default:
+		state = "other"
+	}
+	webhookEvents.WithLabelValues(provider, state).Inc()
+}
+
+func observeMongo(operation string, start time.Time) {
+	mongoOperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+type InstrumentedApiCommunicator struct {
+	ApiCommunicator
+}
+
+func (self InstrumentedApiCommunicator) Get(url string) (*http.Response, error) {
+	start := time.Now()
+	response, err := self.ApiCommunicator.Get(url)
+	observeGithub(start, response)
+	return response, err
+}
+
+func (self InstrumentedApiCommunicator) Do(request *http.Request) (*http.Response, error) {
+	start := time.Now()
+	response, err := self.ApiCommunicator.Do(request)
+	observeGithub(start, response)
+	return response, err
+}
+
+func observeGithub(start time.Time, response *http.Response) {
+	githubRequestDuration.Observe(time.Since(start).Seconds())
+	if response == nil {
+		return
+	}
+	if remaining, err := strconv.Atoi(response.Header.Get("X-RateLimit-Remaining")); err == nil {
+		githubRateLimitRemaining.Set(float64(remaining))
+	}
+}
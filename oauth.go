@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"gopkg.in/mgo.v2"
+)
+
+const (
+	OAuthStateTTL     = 10 * time.Minute
+	sealedTokenPrefix = "sealed:"
+)
+
+var GithubNotConfiguredError = NewUnavailableError("Sign in with GitHub is not configured.")
+var OAuthStateInvalidError = NewValidationError("The GitHub sign in has expired or was already used.")
+var RepositoryForbiddenError = NewForbiddenError("The linked GitHub account can not see this repository.")
+var PublicRepositoryOnlyError = NewForbiddenError("Only public repositories can be subscribed to without a linked GitHub account.")
+
+type GithubConfig struct {
+	ClientId     string
+	ClientSecret string
+	RedirectUrl  string
+	OAuthUrl     string
+	ApiUrl       string
+	tokenCipher  cipher.AEAD
+}
+
+func GithubConfigFromEnv() (GithubConfig, error) {
+	config := GithubConfig{
+		ClientId:     os.Getenv("GITHUB_CLIENT_ID"),
+		ClientSecret: os.Getenv("GITHUB_CLIENT_SECRET"),
+		RedirectUrl:  os.Getenv("GITHUB_REDIRECT_URL"),
+		OAuthUrl:     strings.TrimSuffix(os.Getenv("GITHUB_OAUTH_URL"), "/"),
+		ApiUrl:       strings.TrimSuffix(os.Getenv("GITHUB_API_URL"), "/"),
+	}
+	if config.OAuthUrl == "" {
+		config.OAuthUrl = "https://github.com"
+	}
+	if config.ApiUrl == "" {
+		config.ApiUrl = "https://api.github.com"
+	}
+
+	if tokenKey := os.Getenv("GITHUB_TOKEN_KEY"); tokenKey != "" || config.IsConfigured() {
+		key, err := hex.DecodeString(tokenKey)
+		if err != nil || len(key) != 32 {
+			return GithubConfig{}, fmt.Errorf("GITHUB_TOKEN_KEY must be 64 hex characters when sign in with GitHub is configured.")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return GithubConfig{}, err
+		}
+		if config.tokenCipher, err = cipher.NewGCM(block); err != nil {
+			return GithubConfig{}, err
+		}
+	}
+	return config, nil
+}
+
+func (self GithubConfig) IsConfigured() bool {
+	return self.ClientId != "" && self.ClientSecret != ""
+}
+
+func (self GithubConfig) AuthorizeUrl(state string) string {
+	query := url.Values{}
+	query.Set("client_id", self.ClientId)
+	query.Set("scope", "repo read:org")
+	query.Set("state", state)
+	if self.RedirectUrl != "" {
+		query.Set("redirect_uri", self.RedirectUrl)
+	}
+	return self.OAuthUrl + "/login/oauth/authorize?" + query.Encode()
+}
+
+func (self GithubConfig) SealToken(token string) (string, error) {
+	nonce := make([]byte, self.tokenCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := self.tokenCipher.Seal(nonce, nonce, []byte(token), nil)
+	return sealedTokenPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (self GithubConfig) OpenToken(stored string) (string, error) {
+	if !strings.HasPrefix(stored, sealedTokenPrefix) {
+		return stored, nil
+	}
+	if self.tokenCipher == nil {
+		return "", fmt.Errorf("A sealed GitHub token can not be opened without GITHUB_TOKEN_KEY.")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, sealedTokenPrefix))
+	if err != nil {
+		return "", err
+	}
+	nonceSize := self.tokenCipher.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", fmt.Errorf("The sealed GitHub token is truncated.")
+	}
+	token, err := self.tokenCipher.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	return string(token), err
+}
+
+type GithubAuthorization struct {
+	Url string
+}
+
+type GithubLink struct {
+	UserId      string
+	GithubLogin string
+}
+
+func (self *SidewinderDirector) StartGithubAuthorization(userId string, writer http.ResponseWriter, request *http.Request) error {
+	if !self.Github.IsConfigured() {
+		return GithubNotConfiguredError
+	}
+
+	state, err := newKey()
+	if err != nil {
+		return err
+	}
+	if err := self.StoreWith(request.Context()).AddOAuthState(state, userId); err != nil {
+		return err
+	}
+	return writeJson(201, GithubAuthorization{self.Github.AuthorizeUrl(state)}, writer, request)
+}
+
+func (self *SidewinderDirector) GithubAuthorize(context web.C, writer http.ResponseWriter, request *http.Request) error {
+	if !self.Github.IsConfigured() {
+		return GithubNotConfiguredError
+	}
+
+	state := request.URL.Query().Get("state")
+	if _, err := self.StoreWith(request.Context()).FindOAuthState(state); err == mgo.ErrNotFound {
+		return OAuthStateInvalidError
+	} else if err != nil {
+		return err
+	}
+
+	http.Redirect(writer, request, self.Github.AuthorizeUrl(state), http.StatusFound)
+	return nil
+}
+
+func (self *SidewinderDirector) GithubCallback(context web.C, writer http.ResponseWriter, request *http.Request) error {
+	if !self.Github.IsConfigured() {
+		return GithubNotConfiguredError
+	}
+
+	query := request.URL.Query()
+	userId, err := self.StoreWith(request.Context()).ClaimOAuthState(query.Get("state"))
+	if err == mgo.ErrNotFound {
+		return OAuthStateInvalidError
+	} else if err != nil {
+		return err
+	}
+	if errorCode := query.Get("error"); errorCode != "" {
+		return NewValidationError("GitHub sign in failed: " + errorCode)
+	}
+
+	token, err := self.exchangeGithubCode(request.Context(), query.Get("code"))
+	if err != nil {
+		return err
+	}
+	login, err := self.githubLogin(request.Context(), token)
+	if err != nil {
+		return err
+	}
+
+	sealedToken, err := self.Github.SealToken(token)
+	if err != nil {
+		return err
+	}
+	if err := self.StoreWith(request.Context()).LinkGithubAccount(userId, login, sealedToken); err != nil {
+		return err
+	}
+	return writeJson(200, GithubLink{userId, login}, writer, request)
+}
+
+func (self *SidewinderDirector) exchangeGithubCode(ctx context.Context, code string) (string, error) {
+	form := url.Values{}
+	form.Set("client_id", self.Github.ClientId)
+	form.Set("client_secret", self.Github.ClientSecret)
+	form.Set("code", code)
+	if self.Github.RedirectUrl != "" {
+		form.Set("redirect_uri", self.Github.RedirectUrl)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", self.Github.OAuthUrl+"/login/oauth/access_token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+
+	var tokenResponse struct {
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := self.githubJson(request, &tokenResponse); err != nil {
+		return "", err
+	}
+	if tokenResponse.AccessToken == "" {
+		return "", githubError(fmt.Errorf("GitHub did not issue an access token.\n%v %v", tokenResponse.Error, tokenResponse.ErrorDescription))
+	}
+	return tokenResponse.AccessToken, nil
+}
+
+func (self *SidewinderDirector) githubLogin(ctx context.Context, token string) (string, error) {
+	request, err := self.githubApiRequest(ctx, "/user", token)
+	if err != nil {
+		return "", err
+	}
+
+	var user struct{ Login string }
+	if err := self.githubJson(request, &user); err != nil {
+		return "", err
+	}
+	return user.Login, nil
+}
+
+func (self *SidewinderDirector) githubApiRequest(ctx context.Context, path string, token string) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", self.Github.ApiUrl+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "application/vnd.github.v3+json")
+	if token != "" {
+		request.Header.Set("Authorization", "token "+token)
+	}
+	return request, nil
+}
+
+func (self *SidewinderDirector) githubGet(ctx context.Context, path string) (*http.Response, error) {
+	request, err := self.githubApiRequest(ctx, path, "")
+	if err != nil {
+		return nil, err
+	}
+	response, err := self.Api(ctx).Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		response.Body.Close()
+		return nil, fmt.Errorf("GitHub responded %v to %v.", response.Status, request.URL.Path)
+	}
+	return response, nil
+}
+
+func (self *SidewinderDirector) githubJson(request *http.Request, value interface{}) error {
+	response, err := self.Api(request.Context()).Do(request)
+	if err != nil {
+		return githubError(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return githubError(fmt.Errorf("GitHub responded %v to %v.", response.Status, request.URL.Path))
+	}
+	if err := json.NewDecoder(response.Body).Decode(value); err != nil {
+		return githubError(err)
+	}
+	return nil
+}
+
+func githubError(err error) error {
+	return NewUpstreamError("The GitHub API request failed.", err)
+}
+
+func (self *SidewinderDirector) githubUser(ctx context.Context, userId string) (UserDocument, string, error) {
+	if userId == "" {
+		return UserDocument{}, "", nil
+	}
+	user, err := self.StoreWith(ctx).FindUser(userId)
+	if err != nil || user.GithubToken == "" {
+		return user, "", err
+	}
+
+	token, err := self.Github.OpenToken(user.GithubToken)
+	if err != nil {
+		return user, "", err
+	}
+	if !strings.HasPrefix(user.GithubToken, sealedTokenPrefix) && self.Github.tokenCipher != nil {
+		if sealedToken, err := self.Github.SealToken(token); err != nil {
+			return user, "", err
+		} else if err := self.StoreWith(ctx).LinkGithubAccount(userId, user.GithubLogin, sealedToken); err != nil {
+			return user, "", err
+		}
+	}
+	return user, token, nil
+}
+
+func (self *SidewinderDirector) canSeeRepository(ctx context.Context, userId string, repositoryName string) (bool, error) {
+	if !isGithubRepository(repositoryName) {
+		return true, nil
+	}
+
+	user, token, err := self.githubUser(ctx, userId)
+	if err != nil {
+		return false, err
+	}
+	if owner, isWildcard := wildcardOwner(repositoryName); isWildcard {
+		if token == "" {
+			return false, OwnerRequiresGithubError
+		}
+		if strings.EqualFold(owner, user.GithubLogin) {
+			return true, nil
+		}
+		return self.isActiveMember(ctx, owner, token)
+	}
+	if token == "" {
+		return self.isPublicRepository(ctx, repositoryName)
+	}
+
+	request, err := self.githubApiRequest(ctx, "/repos/"+repositoryName, token)
+	if err != nil {
+		return false, err
+	}
+	response, err := self.Api(ctx).Do(request)
+	if err != nil {
+		return false, githubError(err)
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case 200:
+		return true, nil
+	case 403, 404:
+		return false, nil
+	default:
+		return false, githubError(fmt.Errorf("GitHub responded %v when checking access to %v.", response.Status, repositoryName))
+	}
+}
+
+func (self *SidewinderDirector) isActiveMember(ctx context.Context, organisation string, token string) (bool, error) {
+	request, err := self.githubApiRequest(ctx, "/user/memberships/orgs/"+organisation, token)
+	if err != nil {
+		return false, err
+	}
+	response, err := self.Api(ctx).Do(request)
+	if err != nil {
+		return false, githubError(err)
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case 200:
+		var membership struct{ State string }
+		if err := json.NewDecoder(response.Body).Decode(&membership); err != nil {
+			return false, githubError(err)
+		}
+		return membership.State == "active", nil
+	case 403, 404:
+		return false, nil
+	default:
+		return false, githubError(fmt.Errorf("GitHub responded %v when checking membership of %v.", response.Status, organisation))
+	}
+}
+
+func (self *SidewinderDirector) isPublicRepository(ctx context.Context, repositoryName string) (bool, error) {
+	request, err := self.githubApiRequest(ctx, "/repos/"+repositoryName, "")
+	if err != nil {
+		return false, err
+	}
+	response, err := self.Api(ctx).Do(request)
+	if err != nil {
+		return false, githubError(err)
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case 200:
+		var repository struct{ Private bool }
+		if err := json.NewDecoder(response.Body).Decode(&repository); err != nil {
+			return false, githubError(err)
+		} else if repository.Private {
+			return false, PublicRepositoryOnlyError
+		}
+		return true, nil
+	case 404:
+		return false, PublicRepositoryOnlyError
+	default:
+		return false, githubError(fmt.Errorf("GitHub responded %v when checking whether %v is public.", response.Status, repositoryName))
+	}
+}
+
+func isGithubRepository(repositoryName string) bool {
+	return !strings.Contains(repositoryName, ":") && strings.Count(repositoryName, "/") == 1
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	OpenApiVersion = "3.0.3"
+	OpenApiTitle   = "Sidewinder"
+	schemaPrefix   = "#/components/schemas/"
+)
+
+type Operation struct {
+	Summary  string
+	Status   int
+	Query    []string
+	Request  interface{}
+	Response interface{}
+}
+
+type OpenApiDocument struct {
+	OpenApi    string                                  `json:"openapi"`
+	Info       OpenApiInfo                             `json:"info"`
+	Servers    []OpenApiServer                         `json:"servers"`
+	Paths      map[string]map[string]*OpenApiOperation `json:"paths"`
+	Components OpenApiComponents                       `json:"components"`
+}
+
+type OpenApiInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type OpenApiServer struct {
+	Url string `json:"url"`
+}
+
+type OpenApiComponents struct {
+	Schemas map[string]*Schema `json:"schemas"`
+}
+
+type OpenApiOperation struct {
+	Summary     string                      `json:"summary,omitempty"`
+	Parameters  []OpenApiParameter          `json:"parameters,omitempty"`
+	RequestBody *OpenApiBody                `json:"requestBody,omitempty"`
+	Responses   map[string]*OpenApiResponse `json:"responses"`
+}
+
+type OpenApiParameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required,omitempty"`
+	Schema   *Schema `json:"schema"`
+}
+
+type OpenApiBody struct {
+	Required bool                        `json:"required,omitempty"`
+	Content  map[string]OpenApiMediaType `json:"content"`
+}
+
+type OpenApiResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]OpenApiMediaType `json:"content,omitempty"`
+}
+
+type OpenApiMediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	objectIdType = reflect.TypeOf(bson.ObjectId(""))
+)
+
+func NewOpenApiDocument(version ApiVersion) *OpenApiDocument {
+	document := &OpenApiDocument{
+		OpenApi:    OpenApiVersion,
+		Info:       OpenApiInfo{OpenApiTitle, version.Name},
+		Servers:    []OpenApiServer{{version.Prefix()}},
+		Paths:      make(map[string]map[string]*OpenApiOperation),
+		Components: OpenApiComponents{make(map[string]*Schema)},
+	}
+	document.schemaOf(reflect.TypeOf(ErrorJson{}))
+	document.addEndpoint("", version.Endpoint)
+	return document
+}
+
+func (self *OpenApiDocument) addEndpoint(pattern string, endpoint *RestEndpoint) {
+	handlers := []struct {
+		method  string
+		handler web.Handler
+	}{
+		{"GET", endpoint.Get},
+		{"PUT", endpoint.Put},
+		{"POST", endpoint.Post},
+		{"DELETE", endpoint.Delete},
+	}
+	for _, entry := range handlers {
+		if entry.handler == nil {
+			continue
+		}
+		path, parameters := openApiPath(pattern)
+		if self.Paths[path] == nil {
+			self.Paths[path] = make(map[string]*OpenApiOperation)
+		}
+		self.Paths[path][strings.ToLower(entry.method)] = self.operation(endpoint.Docs[entry.method], parameters)
+	}
+
+	for subpattern, subendpoint := range endpoint.Paths {
+		subendpoint := subendpoint
+		self.addEndpoint(pattern+subpattern, &subendpoint)
+	}
+}
+
+func (self *OpenApiDocument) operation(docs Operation, parameters []OpenApiParameter) *OpenApiOperation {
+	for _, name := range docs.Query {
+		parameters = append(parameters, OpenApiParameter{Name: name, In: "query", Schema: &Schema{Type: "string"}})
+	}
+	operation := &OpenApiOperation{
+		Summary:    docs.Summary,
+		Parameters: parameters,
+		Responses: map[string]*OpenApiResponse{
+			"default": {"An error.", jsonContent(self.schemaOf(reflect.TypeOf(ErrorJson{})))},
+		},
+	}
+	if docs.Request != nil {
+		operation.RequestBody = &OpenApiBody{true, jsonContent(self.schemaOf(reflect.TypeOf(docs.Request)))}
+	}
+
+	status := docs.Status
+	if status == 0 {
+		status = 200
+	}
+	response := &OpenApiResponse{Description: http.StatusText(status)}
+	if docs.Response != nil {
+		response.Content = jsonContent(self.schemaOf(reflect.TypeOf(docs.Response)))
+	}
+	operation.Responses[strconv.Itoa(status)] = response
+	return operation
+}
+
+func jsonContent(schema *Schema) map[string]OpenApiMediaType {
+	return map[string]OpenApiMediaType{JsonMediaType: {schema}}
+}
+
+func openApiPath(pattern string) (string, []OpenApiParameter) {
+	var parameters []OpenApiParameter
+	segments := strings.Split(pattern, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			name := segment[1:]
+			segments[i] = "{" + name + "}"
+			parameters = append(parameters, OpenApiParameter{name, "path", true, &Schema{Type: "string"}})
+		}
+	}
+	return strings.Join(segments, "/"), parameters
+}
+
+func (self *OpenApiDocument) schemaOf(valueType reflect.Type) *Schema {
+	for valueType.Kind() == reflect.Ptr {
+		valueType = valueType.Elem()
+	}
+
+	switch {
+	case valueType == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case valueType == objectIdType:
+		return &Schema{Type: "string"}
+	}
+
+	switch valueType.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: self.schemaOf(valueType.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: self.schemaOf(valueType.Elem())}
+	case reflect.Struct:
+		if valueType.Name() == "" {
+			return self.structSchema(valueType)
+		}
+		if _, known := self.Components.Schemas[valueType.Name()]; !known {
+			schema := &Schema{}
+			self.Components.Schemas[valueType.Name()] = schema
+			*schema = *self.structSchema(valueType)
+		}
+		return &Schema{Ref: schemaPrefix + valueType.Name()}
+	}
+	return &Schema{}
+}
+
+func (self *OpenApiDocument) structSchema(valueType reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" || field.PkgPath != "" {
+			continue
+		}
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			for embeddedName, embedded := range self.structSchema(field.Type).Properties {
+				schema.Properties[embeddedName] = embedded
+			}
+			continue
+		} else if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = self.schemaOf(field.Type)
+	}
+	return schema
+}
+
+func (self *OpenApiDocument) Handler() web.Handler {
+	return RestHandler(func(context web.C, writer http.ResponseWriter, request *http.Request) error {
+		return writeJson(200, self, writer, request)
+	})
+}
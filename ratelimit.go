@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+var RateLimitedError = NewApiError(429, CodeRateLimited, "Too many requests, try again later.")
+
+type RateLimitKey func(context web.C, request *http.Request) string
+
+type RateLimiter struct {
+	Requests  int
+	Per       time.Duration
+	Key       RateLimitKey
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func NewRateLimiter(requests int, per time.Duration, key RateLimitKey) *RateLimiter {
+	return &RateLimiter{
+		Requests: requests,
+		Per:      per,
+		Key:      key,
+		buckets:  make(map[string]*tokenBucket),
+	}
+}
+
+func ByClient(context web.C, request *http.Request) string {
+	return clientIp(request)
+}
+
+func (self *RateLimiter) LimitDevice(handler DeviceHandler) DeviceHandler {
+	return func(deviceId string, writer http.ResponseWriter, request *http.Request) error {
+		if allowed, wait := self.Take(deviceId); !allowed {
+			setRetryAfter(writer, wait)
+			return RateLimitedError
+		}
+		return handler(deviceId, writer, request)
+	}
+}
+
+func (self *RateLimiter) Take(key string) (bool, time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	now := time.Now()
+	rate := float64(self.Requests) / self.Per.Seconds()
+	self.sweep(now)
+
+	bucket := self.buckets[key]
+	if bucket == nil {
+		bucket = &tokenBucket{float64(self.Requests), now}
+		self.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(self.Requests), bucket.tokens+now.Sub(bucket.updated).Seconds()*rate)
+	bucket.updated = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+}
+
+func (self *RateLimiter) sweep(now time.Time) {
+	if now.Sub(self.lastSweep) < self.Per {
+		return
+	}
+	for key, bucket := range self.buckets {
+		if now.Sub(bucket.updated) >= self.Per {
+			delete(self.buckets, key)
+		}
+	}
+	self.lastSweep = now
+}
+
+func (self *RateLimiter) Limit(handler web.Handler) web.Handler {
+	return web.HandlerFunc(func(context web.C, writer http.ResponseWriter, request *http.Request) {
+		allowed, wait := self.Take(self.Key(context, request))
+		if !allowed {
+			setRetryAfter(writer, wait)
+			writeError(writer, request, RateLimitedError)
+			return
+		}
+		handler.ServeHTTPC(context, writer, request)
+	})
+}
+
+func setRetryAfter(writer http.ResponseWriter, wait time.Duration) {
+	writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+func clientIp(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	JsonMediaType    = "application/json"
+	MsgpackMediaType = "application/msgpack"
+)
+
+var NotAcceptableError = NewApiError(406, CodeNotAcceptable, "Responses can only be sent as application/json or application/msgpack.")
+
+var mediaTypeAliases = map[string]string{
+	"*/*":                   JsonMediaType,
+	"application/*":         JsonMediaType,
+	JsonMediaType:           JsonMediaType,
+	MsgpackMediaType:        MsgpackMediaType,
+	"application/x-msgpack": MsgpackMediaType,
+}
+
+var Accepted = Acknowledgement{"Accepted."}
+
+type Acknowledgement struct {
+	Message string
+}
+
+type LastModifier interface {
+	LastModified() time.Time
+}
+
+type mediaTypeContextKey struct{}
+
+func Negotiated(handler web.Handler) web.Handler {
+	return web.HandlerFunc(func(c web.C, writer http.ResponseWriter, request *http.Request) {
+		mediaType := negotiateMediaType(request.Header.Get("Accept"))
+		if mediaType == "" {
+			failRequest(c, writer, request, NotAcceptableError)
+			return
+		}
+		ctx := context.WithValue(request.Context(), mediaTypeContextKey{}, mediaType)
+		handler.ServeHTTPC(c, writer, request.WithContext(ctx))
+	})
+}
+
+func responseMediaType(request *http.Request) string {
+	if mediaType, ok := request.Context().Value(mediaTypeContextKey{}).(string); ok {
+		return mediaType
+	}
+	if mediaType := negotiateMediaType(request.Header.Get("Accept")); mediaType != "" {
+		return mediaType
+	}
+	return JsonMediaType
+}
+
+func writeJson(code int, value interface{}, writer http.ResponseWriter, request *http.Request) error {
+	mediaType := responseMediaType(request)
+	body, err := encodeResponse(mediaType, value, isPretty(request))
+	if err != nil {
+		return err
+	}
+
+	header := writer.Header()
+	header.Set("Content-Type", mediaType)
+	header.Add("Vary", "Accept")
+	if request.Method == "GET" && code == 200 {
+		sum := sha1.Sum(body)
+		etag := `"` + hex.EncodeToString(sum[:]) + `"`
+		header.Set("ETag", etag)
+
+		var modified time.Time
+		if modifier, ok := value.(LastModifier); ok {
+			modified = modifier.LastModified().UTC().Truncate(time.Second)
+		}
+		if !modified.IsZero() {
+			header.Set("Last-Modified", modified.Format(http.TimeFormat))
+		}
+		if isNotModified(request, etag, modified) {
+			writer.WriteHeader(304)
+			return nil
+		}
+	}
+
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	writer.WriteHeader(code)
+	_, err = writer.Write(body)
+	return err
+}
+
+func negotiateMediaType(accept string) string {
+	if strings.TrimSpace(accept) == "" {
+		return JsonMediaType
+	}
+
+	chosen, chosenQuality, chosenWildcard := "", 0.0, false
+	for _, entry := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(entry))
+		if err != nil {
+			continue
+		}
+		mediaType, supported := mediaTypeAliases[mediaRange]
+		if !supported {
+			continue
+		}
+
+		quality := 1.0
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			quality = q
+		}
+		wildcard := strings.HasSuffix(mediaRange, "*")
+		if quality > chosenQuality || (quality == chosenQuality && chosenWildcard && !wildcard) {
+			chosen, chosenQuality, chosenWildcard = mediaType, quality, wildcard
+		}
+	}
+	return chosen
+}
+
+func isPretty(request *http.Request) bool {
+	values, present := request.URL.Query()["pretty"]
+	return present && values[0] != "false" && values[0] != "0"
+}
+
+func encodeResponse(mediaType string, value interface{}, pretty bool) ([]byte, error) {
+	if mediaType == MsgpackMediaType {
+		var buffer bytes.Buffer
+		encoder := msgpack.NewEncoder(&buffer)
+		encoder.SetCustomStructTag("json")
+		err := encoder.Encode(value)
+		return buffer.Bytes(), err
+	}
+
+	var body []byte
+	var err error
+	if pretty {
+		body, err = json.MarshalIndent(value, "", "  ")
+	} else {
+		body, err = json.Marshal(value)
+	}
+	return append(body, '\n'), err
+}
+
+func isNotModified(request *http.Request, etag string, modified time.Time) bool {
+	if match := request.Header.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(request.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.IsZero() && !modified.After(since)
+}
@@ -1,8 +1,6 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
 	"net/http"
 	"strings"
 
@@ -10,40 +8,53 @@ import (
 )
 
 type RestMux struct {
-	Mux     *web.Mux
-	pattern string
+	Mux         *web.Mux
+	pattern     string
+	deprecation *Deprecation
 }
 
 func NewRestMux(pattern string, mux *web.Mux) *RestMux {
-	return &RestMux{mux, pattern}
+	return &RestMux{Mux: mux, pattern: pattern}
+}
+
+func (self *RestMux) Deprecate(deprecation *Deprecation) *RestMux {
+	self.deprecation = deprecation
+	return self
 }
 
 func (self *RestMux) Use(endpointHandler RestEndpointHandler) *RestMux {
 	endpoint := endpointHandler.Point()
+	wrap := func(method string, handler web.Handler) web.Handler {
+		if endpoint.RateLimit != nil {
+			handler = endpoint.RateLimit.Limit(handler)
+		}
+		handler = Negotiated(handler)
+		if self.deprecation != nil {
+			handler = self.deprecation.Wrap(handler)
+		}
+		return instrument(self.pattern, method, handler)
+	}
+
 	var methods []string
 	if endpoint.Get != nil {
-		self.Mux.Get(self.pattern, endpoint.Get)
+		self.Mux.Get(self.pattern, wrap("GET", endpoint.Get))
 		methods = append(methods, "GET")
 	}
 	if endpoint.Post != nil {
-		self.Mux.Post(self.pattern, endpoint.Post)
+		self.Mux.Post(self.pattern, wrap("POST", endpoint.Post))
 		methods = append(methods, "POST")
 	}
 	if endpoint.Put != nil {
-		self.Mux.Put(self.pattern, endpoint.Put)
+		self.Mux.Put(self.pattern, wrap("PUT", endpoint.Put))
 		methods = append(methods, "PUT")
 	}
 	if endpoint.Delete != nil {
 		methods = append(methods, "DELETE")
-		self.Mux.Delete(self.pattern, endpoint.Delete)
+		self.Mux.Delete(self.pattern, wrap("DELETE", endpoint.Delete))
 	}
 	if len(methods) > 0 {
 		self.Mux.Options(self.pattern, func(context web.C, writer http.ResponseWriter, request *http.Request) {
-			methodListString := strings.Join(methods, ", ")
-			writer.Header().Set("Allow", methodListString)
-			writer.Header().Set("Access-Control-Allow-Methods", methodListString)
-			writer.Header().Set("Access-Control-Allow-Origin", "*")
-			writer.Header().Set("Access-Control-Allow-Headers", request.Header.Get("Access-Control-Request-Headers"))
+			writer.Header().Set("Allow", strings.Join(methods, ", "))
 		})
 	}
 
@@ -55,7 +66,7 @@ func (self *RestMux) Use(endpointHandler RestEndpointHandler) *RestMux {
 
 func (self *RestMux) Handle(pattern string, endpointHandler RestEndpointHandler) *RestMux {
 	endpoint := endpointHandler.Point()
-	newRestMux := NewRestMux(self.pattern+pattern, self.Mux)
+	newRestMux := NewRestMux(self.pattern+pattern, self.Mux).Deprecate(self.deprecation)
 	newRestMux.Use(endpoint)
 	return newRestMux
 }
@@ -71,11 +82,13 @@ func (self RestEndpointFunc) Point() *RestEndpoint {
 }
 
 type RestEndpoint struct {
-	Get    web.Handler
-	Put    web.Handler
-	Post   web.Handler
-	Delete web.Handler
-	Paths  map[string]RestEndpoint
+	Get       web.Handler
+	Put       web.Handler
+	Post      web.Handler
+	Delete    web.Handler
+	Paths     map[string]RestEndpoint
+	RateLimit *RateLimiter
+	Docs      map[string]Operation
 }
 
 func (self *RestEndpoint) Point() *RestEndpoint {
@@ -93,15 +106,7 @@ func (self *RestEndpoint) Route(pattern string, endpoint RestEndpoint) *RestEndp
 type RestHandler func(context web.C, writer http.ResponseWriter, request *http.Request) error
 
 func (self RestHandler) ServeHTTPC(context web.C, writer http.ResponseWriter, request *http.Request) {
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
 	if err := self(context, writer, request); err != nil {
-		fmt.Printf("ERROR:  %v\n", err.Error())
-		writeJson(500, ErrorJson{err.Error()}, writer)
+		failRequest(context, writer, request, err)
 	}
 }
-
-func writeJson(code int, value interface{}, writer http.ResponseWriter) error {
-	writer.WriteHeader(code)
-	writer.Header().Set("Content-Type", "application/json")
-	return json.NewEncoder(writer).Encode(value)
-}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -8,6 +13,7 @@ import (
 type SidewinderStore struct {
 	mongoDB string
 	session *mgo.Session
+	ctx     context.Context
 }
 
 func (self *SidewinderStore) DB() *mgo.Database {
@@ -18,13 +24,63 @@ func (self *SidewinderStore) Close() {
 	self.session.Close()
 }
 
+func (self *SidewinderStore) observe(operation string) func() {
+	start := time.Now()
+	if self.ctx == nil {
+		return func() { observeMongo(operation, start) }
+	}
+
+	_, span := tracer.Start(self.ctx, operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "mongodb"),
+			attribute.String("db.name", self.mongoDB),
+			attribute.String("db.operation", operation)))
+	return func() {
+		span.End()
+		observeMongo(operation, start)
+	}
+}
+
 type DeviceDocument struct {
 	DeviceId string `_id`
+	KeyHash  string `json:"-"`
+	UserId   string `json:",omitempty"`
 }
 
-func (self *SidewinderStore) AddDevice(deviceId string) (bool, error) {
-	document := DeviceDocument{deviceId}
-	return wasInserted(self.DB().C("devices").UpsertId(deviceId, document))
+func (self *SidewinderStore) AddDevice(deviceId string, keyHash string) (bool, error) {
+	defer self.observe("AddDevice")()
+	document := DeviceDocument{DeviceId: deviceId, KeyHash: keyHash}
+	return wasCreated(self.DB().C("devices").Insert(document))
+}
+
+func wasCreated(err error) (bool, error) {
+	switch {
+	case mgo.IsDup(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	default:
+		return true, nil
+	}
+}
+
+func (self *SidewinderStore) SetDeviceKeyHash(deviceId string, keyHash string) error {
+	defer self.observe("SetDeviceKeyHash")()
+	deviceCollection := self.DB().C("devices")
+	return deviceCollection.UpdateId(deviceId, bson.M{"$set": bson.M{"keyhash": keyHash}})
+}
+
+func (self *SidewinderStore) ClaimDeviceKey(deviceId string, keyHash string) (bool, error) {
+	defer self.observe("ClaimDeviceKey")()
+	deviceCollection := self.DB().C("devices")
+	err := deviceCollection.Update(
+		bson.M{"_id": deviceId, "keyhash": bson.M{"$in": []interface{}{"", nil}}},
+		bson.M{"$set": bson.M{"keyhash": keyHash}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
 }
 
 func wasInserted(info *mgo.ChangeInfo, err error) (bool, error) {
@@ -39,6 +95,7 @@ func wasInserted(info *mgo.ChangeInfo, err error) (bool, error) {
 }
 
 func (self *SidewinderStore) FindDevice(deviceId string) (DeviceDocument, error) {
+	defer self.observe("FindDevice")()
 	deviceCollection := self.DB().C("devices")
 
 	var result DeviceDocument
@@ -47,44 +104,533 @@ func (self *SidewinderStore) FindDevice(deviceId string) (DeviceDocument, error)
 }
 
 func (self *SidewinderStore) DeleteDevice(deviceId string) error {
+	defer self.observe("DeleteDevice")()
 	deviceCollection := self.DB().C("devices")
 	return deviceCollection.RemoveId(deviceId)
 }
 
 type RepositoryDocument struct {
-	Name       string   `_id`
-	DeviceList []string `json:"-"`
+	Name             string   `_id`
+	Mode             string   `json:",omitempty" bson:"-"`
+	Via              string   `json:",omitempty" bson:"-"`
+	Repositories     []string `json:",omitempty"`
+	DeviceList       []string `json:"-"`
+	UserList         []string `json:"-"`
+	AuthorDeviceList []string `json:"-"`
+	AuthorUserList   []string `json:"-"`
 }
 
-func (self *SidewinderStore) AddDeviceToRepository(devideId, repositoryName string) (bool, error) {
+func (self *SidewinderStore) AddDeviceToRepository(devideId, repositoryName, mode string) (bool, error) {
+	defer self.observe("AddDeviceToRepository")()
 	repositoryCollection := self.DB().C("repositories")
-	update := struct {
-		Push interface{} `$push`
-	}{struct{ DeviceList string }{devideId}}
-
+	update := subscriptionUpdate("devicelist", "authordevicelist", devideId, mode)
 	return wasInserted(repositoryCollection.UpsertId(repositoryName, update))
 }
 
+func subscriptionUpdate(list, authorList, id, mode string) bson.M {
+	if mode == SubscriptionMine {
+		list, authorList = authorList, list
+	}
+	return bson.M{"$addToSet": bson.M{list: id}, "$pull": bson.M{authorList: id}}
+}
+
 func (self *SidewinderStore) FindRepository(repositoryName string) (*RepositoryDocument, error) {
+	defer self.observe("FindRepository")()
 	repositoryCollection := self.DB().C("repositories")
 	var repository RepositoryDocument
 	err := repositoryCollection.FindId(repositoryName).One(&repository)
 	return &repository, err
 }
 
+func (self *SidewinderStore) MatchingRepositories(repositoryName string) ([]RepositoryDocument, error) {
+	defer self.observe("MatchingRepositories")()
+	repositoryCollection := self.DB().C("repositories")
+	names := []string{repositoryName}
+	if wildcard := wildcardFor(repositoryName); wildcard != "" {
+		names = append(names, wildcard)
+	}
+	query := bson.M{"$or": []bson.M{
+		{"_id": bson.M{"$in": names}},
+		{"repositories": repositoryName},
+	}}
+
+	result := make([]RepositoryDocument, 0)
+	err := repositoryCollection.Find(query).All(&result)
+	return result, err
+}
+
+func (self *SidewinderStore) SetTeamRepositories(teamName string, repositories []string) error {
+	defer self.observe("SetTeamRepositories")()
+	repositoryCollection := self.DB().C("repositories")
+	_, err := repositoryCollection.UpsertId(teamName, bson.M{"$set": bson.M{"repositories": repositories}})
+	return err
+}
+
+func (self *SidewinderStore) Teams() ([]RepositoryDocument, error) {
+	defer self.observe("Teams")()
+	repositoryCollection := self.DB().C("repositories")
+	result := make([]RepositoryDocument, 0)
+	err := repositoryCollection.Find(bson.M{"_id": bson.M{"$regex": "^@"}}).All(&result)
+	return result, err
+}
+
 func (self *SidewinderStore) RepositoriesForDevice(deviceId string) ([]RepositoryDocument, error) {
+	defer self.observe("RepositoriesForDevice")()
+	result, err := self.subscriptionsFor("devicelist", "authordevicelist", deviceId)
+	for index := range result {
+		if contains(result[index].AuthorDeviceList, deviceId) {
+			result[index].Mode = SubscriptionMine
+		}
+	}
+	return result, err
+}
+
+func (self *SidewinderStore) subscriptionsFor(list, authorList, id string) ([]RepositoryDocument, error) {
+	repositoryCollection := self.DB().C("repositories")
+	query := bson.M{"$or": []bson.M{{list: id}, {authorList: id}}}
+	result := make([]RepositoryDocument, 0)
+	err := repositoryCollection.Find(query).Select(bson.M{"_id": 1, "repositories": 1, authorList: 1}).All(&result)
+	return result, err
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *SidewinderStore) SubscribedDevices(repository *RepositoryDocument, authors []string) ([]string, error) {
+	defer self.observe("SubscribedDevices")()
+	deviceIds := make([]string, 0, len(repository.DeviceList))
+	seen := make(map[string]bool)
+	add := func(deviceId string) {
+		if !seen[deviceId] {
+			seen[deviceId] = true
+			deviceIds = append(deviceIds, deviceId)
+		}
+	}
+
+	for _, deviceId := range repository.DeviceList {
+		add(deviceId)
+	}
+	if len(repository.UserList) > 0 {
+		var userDevices []DeviceDocument
+		query := bson.M{"userid": bson.M{"$in": repository.UserList}}
+		if err := self.DB().C("devices").Find(query).Select(bson.M{"_id": 1}).All(&userDevices); err != nil {
+			return nil, err
+		}
+		for _, device := range userDevices {
+			add(device.DeviceId)
+		}
+	}
+
+	authorDevices, err := self.authorDevices(repository, authors)
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range authorDevices {
+		add(device.DeviceId)
+	}
+	return deviceIds, nil
+}
+
+func (self *SidewinderStore) authorDevices(repository *RepositoryDocument, authors []string) ([]DeviceDocument, error) {
+	var subscribers []bson.M
+	if len(repository.AuthorDeviceList) > 0 {
+		subscribers = append(subscribers, bson.M{"_id": bson.M{"$in": repository.AuthorDeviceList}})
+	}
+	if len(repository.AuthorUserList) > 0 {
+		subscribers = append(subscribers, bson.M{"userid": bson.M{"$in": repository.AuthorUserList}})
+	}
+	if len(authors) == 0 || len(subscribers) == 0 {
+		return nil, nil
+	}
+
+	var authorUsers []UserDocument
+	userQuery := bson.M{"githublogin": bson.M{"$in": authors}}
+	if err := self.DB().C("users").Find(userQuery).Select(bson.M{"_id": 1}).All(&authorUsers); err != nil {
+		return nil, err
+	}
+	userIds := make([]string, 0, len(authorUsers))
+	for _, user := range authorUsers {
+		userIds = append(userIds, user.UserId)
+	}
+
+	var devices []DeviceDocument
+	deviceQuery := bson.M{"userid": bson.M{"$in": userIds}, "$or": subscribers}
+	err := self.DB().C("devices").Find(deviceQuery).Select(bson.M{"_id": 1}).All(&devices)
+	return devices, err
+}
+
+type UserDocument struct {
+	UserId      string `_id`
+	KeyHash     string `json:"-"`
+	GithubLogin string `json:",omitempty"`
+	GithubToken string `json:"-"`
+}
+
+func (self *SidewinderStore) AddUser(userId string, keyHash string) (bool, error) {
+	defer self.observe("AddUser")()
+	return wasCreated(self.DB().C("users").Insert(UserDocument{UserId: userId, KeyHash: keyHash}))
+}
+
+func (self *SidewinderStore) FindUser(userId string) (UserDocument, error) {
+	defer self.observe("FindUser")()
+	var result UserDocument
+	err := self.DB().C("users").FindId(userId).One(&result)
+	return result, err
+}
+
+func (self *SidewinderStore) SetUserKeyHash(userId string, keyHash string) error {
+	defer self.observe("SetUserKeyHash")()
+	return self.DB().C("users").UpdateId(userId, bson.M{"$set": bson.M{"keyhash": keyHash}})
+}
+
+func (self *SidewinderStore) LinkGithubAccount(userId string, login string, token string) error {
+	defer self.observe("LinkGithubAccount")()
+	update := bson.M{"$set": bson.M{"githublogin": login, "githubtoken": token}}
+	return self.DB().C("users").UpdateId(userId, update)
+}
+
+func (self *SidewinderStore) AttachDevice(userId string, deviceId string) (bool, error) {
+	defer self.observe("AttachDevice")()
+	err := self.DB().C("devices").Update(
+		bson.M{"_id": deviceId, "userid": bson.M{"$in": []interface{}{"", nil}}},
+		bson.M{"$set": bson.M{"userid": userId}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (self *SidewinderStore) DevicesForUser(userId string) ([]DeviceDocument, error) {
+	defer self.observe("DevicesForUser")()
+	result := make([]DeviceDocument, 0)
+	err := self.DB().C("devices").Find(bson.M{"userid": userId}).All(&result)
+	return result, err
+}
+
+func (self *SidewinderStore) AddUserToRepository(userId, repositoryName, mode string) (bool, error) {
+	defer self.observe("AddUserToRepository")()
 	repositoryCollection := self.DB().C("repositories")
+	update := subscriptionUpdate("userlist", "authoruserlist", userId, mode)
+	return wasInserted(repositoryCollection.UpsertId(repositoryName, update))
+}
 
-	queryData := struct {
-		DeviceList string
-	}{deviceId}
+func (self *SidewinderStore) RepositoriesForUser(userId string) ([]RepositoryDocument, error) {
+	defer self.observe("RepositoriesForUser")()
+	result, err := self.subscriptionsFor("userlist", "authoruserlist", userId)
+	for index := range result {
+		if contains(result[index].AuthorUserList, userId) {
+			result[index].Mode = SubscriptionMine
+		}
+	}
+	return result, err
+}
 
-	query := repositoryCollection.Find(queryData)
+type BuildStateDocument struct {
+	Id    string `_id`
+	State string
+}
+
+func buildStateId(repositoryName, branch, context string) string {
+	return repositoryName + "@" + branch + "#" + context
+}
+
+func (self *SidewinderStore) RecordBuildState(repositoryName, branch, context, state string) (string, error) {
+	defer self.observe("RecordBuildState")()
+	buildCollection := self.DB().C("builds")
+	change := mgo.Change{
+		Update: bson.M{"$set": bson.M{"state": state}},
+		Upsert: true,
+	}
+
+	var previous BuildStateDocument
+	_, err := buildCollection.FindId(buildStateId(repositoryName, branch, context)).Apply(change, &previous)
+	return previous.State, err
+}
+
+func (self *SidewinderStore) FindBuildState(repositoryName, branch, context string) (string, error) {
+	defer self.observe("FindBuildState")()
+	buildCollection := self.DB().C("builds")
+
+	var result BuildStateDocument
+	err := buildCollection.FindId(buildStateId(repositoryName, branch, context)).One(&result)
+	if err == mgo.ErrNotFound {
+		return "", nil
+	}
+	return result.State, err
+}
+
+type DeliveryDocument struct {
+	Id         string `_id`
+	ReceivedAt time.Time
+}
+
+func (self *SidewinderStore) EnsureDeliveryIndex(ttl time.Duration) error {
+	defer self.observe("EnsureDeliveryIndex")()
+	return self.ensureExpiryIndex(self.DB().C("deliveries"), "receivedat", ttl)
+}
+
+func (self *SidewinderStore) ensureExpiryIndex(collection *mgo.Collection, key string, ttl time.Duration) error {
+	indexes, err := collection.Indexes()
+	if err != nil && !isNamespaceMissing(err) {
+		return err
+	}
+	for _, index := range indexes {
+		if len(index.Key) != 1 || index.Key[0] != key {
+			continue
+		} else if index.ExpireAfter == ttl {
+			return nil
+		}
+		return self.DB().Run(bson.D{
+			{Name: "collMod", Value: collection.Name},
+			{Name: "index", Value: bson.M{"keyPattern": bson.M{key: 1}, "expireAfterSeconds": int(ttl.Seconds())}},
+		}, nil)
+	}
+	return collection.EnsureIndex(mgo.Index{Key: []string{key}, ExpireAfter: ttl})
+}
+
+func isNamespaceMissing(err error) bool {
+	queryError, ok := err.(*mgo.QueryError)
+	return ok && queryError.Code == 26
+}
+
+func (self *SidewinderStore) RecordDelivery(deliveryId string) (bool, error) {
+	defer self.observe("RecordDelivery")()
+	deliveryCollection := self.DB().C("deliveries")
+	return wasCreated(deliveryCollection.Insert(DeliveryDocument{deliveryId, time.Now()}))
+}
+
+func (self *SidewinderStore) ForgetDelivery(deliveryId string) error {
+	defer self.observe("ForgetDelivery")()
+	deliveryCollection := self.DB().C("deliveries")
+	return deliveryCollection.RemoveId(deliveryId)
+}
+
+type WebhookDocument struct {
+	Id         bson.ObjectId `_id`
+	Provider   string
+	ReceivedAt time.Time
+	Headers    map[string][]string
+	Body       string
+}
+
+func (self WebhookDocument) LastModified() time.Time {
+	return self.ReceivedAt
+}
+
+type WebhookDocuments []WebhookDocument
+
+func (self WebhookDocuments) LastModified() time.Time {
+	var latest time.Time
+	for _, webhook := range self {
+		if webhook.ReceivedAt.After(latest) {
+			latest = webhook.ReceivedAt
+		}
+	}
+	return latest
+}
+
+func (self *SidewinderStore) EnsureWebhookArchive(maxBytes int) error {
+	defer self.observe("EnsureWebhookArchive")()
+	names, err := self.DB().CollectionNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == "webhooks" {
+			return nil
+		}
+	}
+	return self.DB().C("webhooks").Create(&mgo.CollectionInfo{Capped: true, MaxBytes: maxBytes})
+}
+
+func (self *SidewinderStore) ArchiveWebhook(webhook WebhookDocument) error {
+	defer self.observe("ArchiveWebhook")()
+	webhookCollection := self.DB().C("webhooks")
+	return webhookCollection.Insert(webhook)
+}
+
+func (self *SidewinderStore) RecentWebhooks(limit int) (WebhookDocuments, error) {
+	defer self.observe("RecentWebhooks")()
+	webhookCollection := self.DB().C("webhooks")
+	result := make(WebhookDocuments, 0)
+	err := webhookCollection.Find(nil).Sort("-_id").Limit(limit).All(&result)
+	return result, err
+}
+
+func (self *SidewinderStore) FindWebhook(webhookId string) (*WebhookDocument, error) {
+	defer self.observe("FindWebhook")()
+	if !bson.IsObjectIdHex(webhookId) {
+		return nil, mgo.ErrNotFound
+	}
+	webhookCollection := self.DB().C("webhooks")
+	var webhook WebhookDocument
+	err := webhookCollection.FindId(bson.ObjectIdHex(webhookId)).One(&webhook)
+	return &webhook, err
+}
+
+type OAuthStateDocument struct {
+	State     string `_id`
+	UserId    string
+	CreatedAt time.Time
+}
+
+func (self *SidewinderStore) EnsureOAuthStateIndex(ttl time.Duration) error {
+	defer self.observe("EnsureOAuthStateIndex")()
+	return self.ensureExpiryIndex(self.DB().C("oauthstates"), "createdat", ttl)
+}
+
+func (self *SidewinderStore) AddOAuthState(state string, userId string) error {
+	defer self.observe("AddOAuthState")()
+	return self.DB().C("oauthstates").Insert(OAuthStateDocument{state, userId, time.Now()})
+}
+
+func (self *SidewinderStore) FindOAuthState(state string) (OAuthStateDocument, error) {
+	defer self.observe("FindOAuthState")()
+	var result OAuthStateDocument
+	err := self.DB().C("oauthstates").FindId(state).One(&result)
+	return result, err
+}
+
+func (self *SidewinderStore) ClaimOAuthState(state string) (string, error) {
+	defer self.observe("ClaimOAuthState")()
+	var result OAuthStateDocument
+	_, err := self.DB().C("oauthstates").FindId(state).Apply(mgo.Change{Remove: true}, &result)
+	if err == nil && time.Since(result.CreatedAt) > OAuthStateTTL {
+		return "", mgo.ErrNotFound
+	}
+	return result.UserId, err
+}
+
+type ThrottleDocument struct {
+	Id          string `_id`
+	WindowStart time.Time
+	Sent        int
+	Suppressed  int
+}
+
+const MinThrottleTTL = 24 * time.Hour
+
+func throttleTTL(window time.Duration) time.Duration {
+	if window > MinThrottleTTL {
+		return window
+	}
+	return MinThrottleTTL
+}
+
+func (self *SidewinderStore) EnsureThrottleIndex(ttl time.Duration) error {
+	defer self.observe("EnsureThrottleIndex")()
+	return self.ensureExpiryIndex(self.DB().C("throttles"), "windowstart", ttl)
+}
+
+func throttleId(deviceId, repositoryName string) string {
+	return deviceId + "|" + repositoryName
+}
+
+func (self *SidewinderStore) TakePush(deviceId, repositoryName string, limit int, window time.Duration) (bool, int, error) {
+	defer self.observe("TakePush")()
+	throttleCollection := self.DB().C("throttles")
+	id := throttleId(deviceId, repositoryName)
+	now := time.Now()
+
+	expired := bson.M{"_id": id, "windowstart": bson.M{"$lt": now.Add(-window)}}
+	err := throttleCollection.Update(expired, bson.M{"$set": bson.M{"windowstart": now, "sent": 0}})
+	if err != nil && err != mgo.ErrNotFound {
+		return false, 0, err
+	}
+
+	change := mgo.Change{
+		Update: bson.M{
+			"$inc":         bson.M{"sent": 1},
+			"$set":         bson.M{"suppressed": 0},
+			"$setOnInsert": bson.M{"windowstart": now},
+		},
+		Upsert: true,
+	}
+	var previous ThrottleDocument
+	take := func() error {
+		_, err := throttleCollection.Find(bson.M{"_id": id, "sent": bson.M{"$lt": limit}}).Apply(change, &previous)
+		return err
+	}
+	// A duplicate key means the window is full or a concurrent first push inserted it; only a retry can tell.
+	if err = take(); mgo.IsDup(err) {
+		err = take()
+	}
+	switch {
+	case mgo.IsDup(err):
+		return false, 0, throttleCollection.UpdateId(id, bson.M{"$inc": bson.M{"suppressed": 1}})
+	case err == mgo.ErrNotFound:
+		return true, 0, nil
+	case err != nil:
+		return false, 0, err
+	default:
+		return true, previous.Suppressed, nil
+	}
+}
+
+type AdminDocument struct {
+	Name    string `_id`
+	KeyHash string `json:"-"`
+	Role    string
+}
+
+func (self *SidewinderStore) AddAdmin(name string, keyHash string, role string) (bool, error) {
+	defer self.observe("AddAdmin")()
+	return wasCreated(self.DB().C("admins").Insert(AdminDocument{name, keyHash, role}))
+}
+
+func (self *SidewinderStore) FindAdmin(name string) (AdminDocument, error) {
+	defer self.observe("FindAdmin")()
+	var result AdminDocument
+	err := self.DB().C("admins").FindId(name).One(&result)
+	return result, err
+}
+
+func (self *SidewinderStore) FindAdminByKeyHash(keyHash string) (AdminDocument, error) {
+	defer self.observe("FindAdminByKeyHash")()
+	var result AdminDocument
+	err := self.DB().C("admins").Find(bson.M{"keyhash": keyHash}).One(&result)
+	return result, err
+}
+
+func (self *SidewinderStore) AllAdmins() ([]AdminDocument, error) {
+	defer self.observe("AllAdmins")()
+	result := make([]AdminDocument, 0)
+	err := self.DB().C("admins").Find(nil).Sort("_id").All(&result)
+	return result, err
+}
+
+func (self *SidewinderStore) DeleteAdmin(name string) error {
+	defer self.observe("DeleteAdmin")()
+	return self.DB().C("admins").RemoveId(name)
+}
+
+func (self *SidewinderStore) AllDevices() ([]DeviceDocument, error) {
+	defer self.observe("AllDevices")()
+	result := make([]DeviceDocument, 0)
+	err := self.DB().C("devices").Find(nil).Sort("_id").All(&result)
+	return result, err
+}
+
+func (self *SidewinderStore) AllRepositories() ([]RepositoryDocument, error) {
+	defer self.observe("AllRepositories")()
 	result := make([]RepositoryDocument, 0)
-	err := query.Select(bson.M{"_id": 1}).All(&result)
+	err := self.DB().C("repositories").Find(nil).Sort("_id").All(&result)
 	return result, err
 }
 
+func (self *SidewinderStore) RemoveDeviceFromRepository(deviceId, repositoryName string) error {
+	defer self.observe("RemoveDeviceFromRepository")()
+	selector := bson.M{"_id": repositoryName, "$or": []bson.M{{"devicelist": deviceId}, {"authordevicelist": deviceId}}}
+	update := bson.M{"$pull": bson.M{"devicelist": deviceId, "authordevicelist": deviceId}}
+	return self.DB().C("repositories").Update(selector, update)
+}
+
 type DatastoreInfo struct {
 	BuildInfo     mgo.BuildInfo
 	LiveServers   []string
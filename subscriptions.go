@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+const MaxTeamRepositoryPages = 10
+
+var TeamRequiresGithubError = NewValidationError("Team subscriptions need a user with a linked GitHub account.")
+var OwnerRequiresGithubError = NewValidationError("Subscriptions to every repository of an owner need a user with a linked GitHub account.")
+var MineRequiresGithubError = NewValidationError("Subscriptions to your own commits need a user with a linked GitHub account.")
+
+func wildcardFor(repositoryName string) string {
+	slash := strings.LastIndex(repositoryName, "/")
+	if slash < 0 {
+		return ""
+	}
+	return repositoryName[:slash+1] + "*"
+}
+
+func wildcardOwner(repositoryName string) (string, bool) {
+	if !strings.HasSuffix(repositoryName, "/*") {
+		return "", false
+	}
+	return strings.TrimSuffix(repositoryName, "/*"), true
+}
+
+func isTeam(repositoryName string) bool {
+	return strings.HasPrefix(repositoryName, "@") && strings.Count(repositoryName, "/") == 1
+}
+
+func (self *SidewinderDirector) refuseSubscription(ctx context.Context, userId string, repositoryName string) (bool, error) {
+	if !isTeam(repositoryName) {
+		if canSee, err := self.canSeeRepository(ctx, userId, repositoryName); err != nil {
+			return true, err
+		} else if !canSee {
+			return true, RepositoryForbiddenError
+		}
+		return false, nil
+	}
+
+	_, token, err := self.githubUser(ctx, userId)
+	if err != nil {
+		return true, err
+	} else if token == "" {
+		return true, TeamRequiresGithubError
+	}
+
+	organisation := strings.SplitN(strings.TrimPrefix(repositoryName, "@"), "/", 2)[0]
+	if member, err := self.isActiveMember(ctx, organisation, token); err != nil {
+		return true, err
+	} else if !member {
+		return true, RepositoryForbiddenError
+	}
+
+	repositories, found, err := self.teamRepositories(ctx, repositoryName, token)
+	if err != nil {
+		return true, err
+	} else if !found {
+		return true, RepositoryForbiddenError
+	}
+	if err := self.StoreWith(ctx).SetTeamRepositories(repositoryName, repositories); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+func (self *SidewinderDirector) refuseMode(ctx context.Context, userId string, mode string) error {
+	if mode != SubscriptionMine {
+		return nil
+	} else if userId == "" {
+		return MineRequiresGithubError
+	}
+
+	user, err := self.StoreWith(ctx).FindUser(userId)
+	if err != nil {
+		return err
+	} else if user.GithubLogin == "" {
+		return MineRequiresGithubError
+	}
+	return nil
+}
+
+func (self *SidewinderDirector) teamRepositories(ctx context.Context, teamName string, token string) ([]string, bool, error) {
+	team := strings.SplitN(strings.TrimPrefix(teamName, "@"), "/", 2)
+	repositories := make([]string, 0)
+	for page := 1; page <= MaxTeamRepositoryPages; page++ {
+		path := fmt.Sprintf("/orgs/%v/teams/%v/repos?per_page=100&page=%v", team[0], team[1], page)
+		request, err := self.githubApiRequest(ctx, path, token)
+		if err != nil {
+			return nil, false, err
+		}
+		response, err := self.Api(ctx).Do(request)
+		if err != nil {
+			return nil, false, githubError(err)
+		}
+
+		var pageRepositories []struct {
+			FullName string `json:"full_name"`
+		}
+		switch response.StatusCode {
+		case 200:
+			err = json.NewDecoder(response.Body).Decode(&pageRepositories)
+		case 403, 404:
+			response.Body.Close()
+			return nil, false, nil
+		default:
+			err = fmt.Errorf("GitHub responded %v when listing repositories of %v.", response.Status, teamName)
+		}
+		response.Body.Close()
+		if err != nil {
+			return nil, false, githubError(err)
+		}
+
+		for _, repository := range pageRepositories {
+			repositories = append(repositories, repository.FullName)
+		}
+		if len(pageRepositories) < 100 {
+			break
+		}
+	}
+	return repositories, true, nil
+}
+
+func (self *SidewinderDirector) RefreshTeamsEvery(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := self.RefreshTeams(context.Background()); err != nil {
+				Log.Error("Could not refresh team repositories.", err, nil)
+			}
+		}
+	}()
+}
+
+// RefreshTeams lists the repositories of every subscribed team again, with the
+// GitHub account of the first subscriber that can still see the team. Teams no
+// subscriber can see any more are left without repositories.
+func (self *SidewinderDirector) RefreshTeams(ctx context.Context) error {
+	teams, err := self.StoreWith(ctx).Teams()
+	if err != nil {
+		return err
+	}
+	for _, team := range teams {
+		if err := self.refreshTeam(ctx, team); err != nil {
+			Log.Error("Could not refresh team repositories.", err, LogFields{"team": team.Name})
+		}
+	}
+	return nil
+}
+
+func (self *SidewinderDirector) refreshTeam(ctx context.Context, team RepositoryDocument) error {
+	userIds, err := self.teamSubscribers(ctx, team)
+	if err != nil {
+		return err
+	}
+	for _, userId := range userIds {
+		_, token, err := self.githubUser(ctx, userId)
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		} else if token == "" {
+			continue
+		}
+
+		repositories, found, err := self.teamRepositories(ctx, team.Name, token)
+		if err != nil {
+			return err
+		} else if found {
+			return self.StoreWith(ctx).SetTeamRepositories(team.Name, repositories)
+		}
+	}
+	return self.StoreWith(ctx).SetTeamRepositories(team.Name, []string{})
+}
+
+func (self *SidewinderDirector) teamSubscribers(ctx context.Context, team RepositoryDocument) ([]string, error) {
+	userIds := append(append([]string{}, team.UserList...), team.AuthorUserList...)
+	for _, deviceId := range append(append([]string{}, team.DeviceList...), team.AuthorDeviceList...) {
+		device, err := self.StoreWith(ctx).FindDevice(deviceId)
+		if err == mgo.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if device.UserId != "" && !contains(userIds, device.UserId) {
+			userIds = append(userIds, device.UserId)
+		}
+	}
+	return userIds, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type TlsConfig struct {
+	CertFile              string
+	KeyFile               string
+	RedirectAddr          string
+	PublicPort            string
+	HstsMaxAge            time.Duration
+	HstsIncludeSubdomains bool
+}
+
+func TlsConfigFromEnv() (TlsConfig, error) {
+	hstsMaxAge, err := durationFromEnv("HSTS_MAX_AGE", 365*24*time.Hour)
+	if err != nil {
+		return TlsConfig{}, err
+	}
+	config := TlsConfig{
+		CertFile:              os.Getenv("TLS_CERT_FILE"),
+		KeyFile:               os.Getenv("TLS_KEY_FILE"),
+		RedirectAddr:          os.Getenv("TLS_REDIRECT_ADDR"),
+		PublicPort:            os.Getenv("TLS_PUBLIC_PORT"),
+		HstsMaxAge:            hstsMaxAge,
+		HstsIncludeSubdomains: os.Getenv("HSTS_INCLUDE_SUBDOMAINS") == "true",
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return TlsConfig{}, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together.")
+	}
+	return config, nil
+}
+
+func (self TlsConfig) IsEnabled() bool {
+	return self.CertFile != ""
+}
+
+func (self TlsConfig) Hsts(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.TLS != nil && self.HstsMaxAge > 0 {
+			value := "max-age=" + strconv.Itoa(int(self.HstsMaxAge.Seconds()))
+			if self.HstsIncludeSubdomains {
+				value += "; includeSubDomains"
+			}
+			writer.Header().Set("Strict-Transport-Security", value)
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+func (self TlsConfig) RedirectHandler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		host := request.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if self.PublicPort != "" && self.PublicPort != "443" {
+			host = net.JoinHostPort(host, self.PublicPort)
+		}
+		http.Redirect(writer, request, "https://"+host+request.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+type CertificateReloader struct {
+	certFile    string
+	keyFile     string
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+}
+
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	reloader := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (self *CertificateReloader) Reload() error {
+	certificate, err := tls.LoadX509KeyPair(self.certFile, self.keyFile)
+	if err != nil {
+		return fmt.Errorf("Could not load TLS certificate %v.\n%v", self.certFile, err.Error())
+	}
+	self.mutex.Lock()
+	self.certificate = &certificate
+	self.mutex.Unlock()
+	return nil
+}
+
+func (self *CertificateReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.certificate, nil
+}
+
+func (self *CertificateReloader) ReloadOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			if err := self.Reload(); err != nil {
+				Log.Error("Could not reload TLS certificate.", err, LogFields{"cert_file": self.certFile})
+			} else {
+				Log.Info("Reloaded TLS certificate.", LogFields{"cert_file": self.certFile})
+			}
+		}
+	}()
+}
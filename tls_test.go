@@ -0,0 +1,105 @@
+package main_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	server "github.com/sidewinder-team/sidewinder-server"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func writeCertificate(certFile string, keyFile string, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	Expect(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600)).To(Succeed())
+}
+
+var _ = Describe("TLS", func() {
+	Describe("redirect", func() {
+		It("sends plain HTTP requests to the same path over HTTPS.", func() {
+			request := NewRequest("GET", "http://sidewinder.example.com:8080/devices/token/repositories?page=2")
+			responseRecorder := httptest.NewRecorder()
+			server.TlsConfig{}.RedirectHandler().ServeHTTP(responseRecorder, request)
+
+			Expect(responseRecorder.Code).To(Equal(301))
+			Expect(responseRecorder.Header().Get("Location")).To(Equal("https://sidewinder.example.com/devices/token/repositories?page=2"))
+		})
+
+		It("keeps a public port other than 443.", func() {
+			request := NewRequest("GET", "http://sidewinder.example.com/hello/rufus")
+			responseRecorder := httptest.NewRecorder()
+			server.TlsConfig{PublicPort: "8443"}.RedirectHandler().ServeHTTP(responseRecorder, request)
+
+			Expect(responseRecorder.Header().Get("Location")).To(Equal("https://sidewinder.example.com:8443/hello/rufus"))
+		})
+	})
+
+	Describe("certificates", func() {
+		var directory, certFile, keyFile string
+
+		BeforeEach(func() {
+			var err error
+			directory, err = ioutil.TempDir("", "sidewinder-tls")
+			Expect(err).NotTo(HaveOccurred())
+			certFile = filepath.Join(directory, "cert.pem")
+			keyFile = filepath.Join(directory, "key.pem")
+			writeCertificate(certFile, keyFile, "before.example.com")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(directory)
+		})
+
+		commonName := func(reloader *server.CertificateReloader) string {
+			certificate, err := reloader.GetCertificate(nil)
+			Expect(err).NotTo(HaveOccurred())
+			parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+			Expect(err).NotTo(HaveOccurred())
+			return parsed.Subject.CommonName
+		}
+
+		It("serves the new certificate after a reload.", func() {
+			reloader, err := server.NewCertificateReloader(certFile, keyFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(commonName(reloader)).To(Equal("before.example.com"))
+
+			writeCertificate(certFile, keyFile, "after.example.com")
+			Expect(reloader.Reload()).To(Succeed())
+			Expect(commonName(reloader)).To(Equal("after.example.com"))
+		})
+
+		It("keeps the old certificate when the new one can not be loaded.", func() {
+			reloader, err := server.NewCertificateReloader(certFile, keyFile)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ioutil.WriteFile(keyFile, []byte("garbage"), 0600)).To(Succeed())
+			Expect(reloader.Reload()).NotTo(Succeed())
+			Expect(commonName(reloader)).To(Equal("before.example.com"))
+		})
+	})
+})
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TraceContextKey    = "traceContext"
+	TracerName         = "github.com/sidewinder-team/sidewinder-server"
+	DefaultServiceName = "sidewinder-server"
+)
+
+var tracer = otel.Tracer(TracerName)
+
+func init() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+func TracingFromEnv() (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch os.Getenv("OTEL_TRACES_EXPORTER") {
+	case "", "none":
+		return nil, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background())
+	case "stdout", "console":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("OTEL_TRACES_EXPORTER must be one of none, otlp or stdout.")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = DefaultServiceName
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider, nil
+}
+
+func (self *SidewinderDirector) shutdownTracing(timeout time.Duration) error {
+	if self.tracerProvider == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return self.tracerProvider.Shutdown(ctx)
+}
+
+func Trace(c *web.C, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+		ctx, span := tracer.Start(ctx, request.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", request.Method),
+				attribute.String("url.path", request.URL.Path)))
+		defer span.End()
+
+		if c.Env == nil {
+			c.Env = make(map[interface{}]interface{})
+		}
+		c.Env[TraceContextKey] = ctx
+		if spanContext := span.SpanContext(); spanContext.IsValid() {
+			annotate(*c, "trace_id", spanContext.TraceID().String())
+		}
+		handler.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+func traceContext(c web.C) context.Context {
+	if ctx, ok := c.Env[TraceContextKey].(context.Context); ok {
+		return ctx
+	}
+	return context.Background()
+}
+
+func traceRoute(c web.C, route string, method string, code int) {
+	span := trace.SpanFromContext(traceContext(c))
+	span.SetName(method + " " + route)
+	span.SetAttributes(
+		attribute.String("http.route", route),
+		attribute.Int("http.response.status_code", code))
+	if code >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(code))
+	}
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+type TracingApiCommunicator struct {
+	ctx context.Context
+	ApiCommunicator
+	propagateTo []string
+}
+
+func (self *SidewinderDirector) Api(ctx context.Context) ApiCommunicator {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return TracingApiCommunicator{ctx, self.ApiCommunicator, self.TracePropagation}
+}
+
+func (self TracingApiCommunicator) Get(url string) (*http.Response, error) {
+	_, span := tracer.Start(self.ctx, "GET",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", "GET"),
+			attribute.String("url.full", url)))
+	response, err := self.ApiCommunicator.Get(url)
+	traceResponse(span, response)
+	endSpan(span, err)
+	return response, err
+}
+
+func (self TracingApiCommunicator) Do(request *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(self.ctx, request.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", request.Method),
+			attribute.String("url.full", request.URL.String())))
+	request = request.WithContext(ctx)
+	if self.propagatesTo(request.URL.Hostname()) {
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(request.Header))
+	}
+	response, err := self.ApiCommunicator.Do(request)
+	traceResponse(span, response)
+	endSpan(span, err)
+	return response, err
+}
+
+func (self TracingApiCommunicator) propagatesTo(host string) bool {
+	for _, internal := range self.propagateTo {
+		if strings.EqualFold(internal, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func traceResponse(span trace.Span, response *http.Response) {
+	if response != nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", response.StatusCode))
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/zenazn/goji/web"
+	"gopkg.in/mgo.v2"
+)
+
+var AddUserMissingUserIdError = NewValidationError("POST to /users must be a JSON with a UserId property.")
+var AttachDeviceMissingKeyError = NewValidationError("POST to /users/:id/devices must be a JSON with the DeviceId and Key of the device.")
+var AttachDeviceConflictError = NewConflictError("The device is already attached to another user.")
+var UserUnauthorizedError = NewUnauthorizedError("Requests for a user must send its key as a Bearer token.")
+var UserForbiddenError = NewForbiddenError("The key sent is not valid for this user.")
+
+type UserCredentials struct {
+	UserId string
+	Key    string
+}
+
+func (self UserDocument) HasKey(key string) bool {
+	return keyMatches(self.KeyHash, key)
+}
+
+type UserHandler func(id string, writer http.ResponseWriter, request *http.Request) error
+
+func (self UserHandler) ServeHTTPC(context web.C, writer http.ResponseWriter, request *http.Request) {
+	userId := context.URLParams["id"]
+	err := self(userId, writer, request)
+	if err != nil {
+		annotate(context, "user_id", userId)
+		failRequest(context, writer, request, err)
+	}
+}
+
+func (self *SidewinderDirector) UserAuthenticated(handler UserHandler) UserHandler {
+	return func(userId string, writer http.ResponseWriter, request *http.Request) error {
+		user, err := self.StoreWith(request.Context()).FindUser(userId)
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+		if refused, err := refuseUnauthorized(user, UserUnauthorizedError, UserForbiddenError, writer, request); refused {
+			return self.failedAuth(err, writer, request)
+		}
+		return handler(userId, writer, request)
+	}
+}
+
+func (self *SidewinderDirector) postUser(context web.C, writer http.ResponseWriter, request *http.Request) error {
+	var sentJSON UserDocument
+	violations, err := decodeJson(request, &sentJSON)
+	if err != nil {
+		return err
+	}
+	violations.Check(sentJSON.UserId != "", "UserId is required.")
+	if err := violations.Refusal(AddUserMissingUserIdError); err != nil {
+		return err
+	}
+
+	key, err := newKey()
+	if err != nil {
+		return err
+	}
+	recordWasCreated, err := self.StoreWith(request.Context()).AddUser(sentJSON.UserId, hashKey(key))
+	if err != nil {
+		return err
+	} else if recordWasCreated {
+		return writeJson(201, UserCredentials{sentJSON.UserId, key}, writer, request)
+	}
+
+	user, err := self.StoreWith(request.Context()).FindUser(sentJSON.UserId)
+	if err != nil {
+		return err
+	}
+	if refused, err := refuseUnauthorized(user, UserUnauthorizedError, UserForbiddenError, writer, request); refused {
+		return err
+	}
+	return writeJson(200, user, writer, request)
+}
+
+func (self *SidewinderDirector) UserMux() *RestEndpoint {
+	return (&RestEndpoint{}).Route("/devices", RestEndpoint{
+		Get:  self.UserAuthenticated(self.GetUserDevices),
+		Post: self.UserAuthenticated(self.AttachUserDevice),
+		Docs: map[string]Operation{
+			"GET":  {Summary: "List the devices of a user.", Response: []DeviceDocument{}},
+			"POST": {Summary: "Attach a device to a user.", Status: 201, Request: DeviceCredentials{}, Response: DeviceDocument{}},
+		},
+	}).Route("/repositories", RestEndpoint{
+		Get:  self.UserAuthenticated(self.GetUserRepositories),
+		Post: self.UserAuthenticated(self.AddUserRepository),
+		Docs: map[string]Operation{
+			"GET":  {Summary: "List the subscriptions of a user.", Response: []RepositoryDocument{}},
+			"POST": {Summary: "Subscribe a user.", Status: 201, Request: SubscriptionMessage{}, Response: SubscriptionMessage{}},
+		},
+	}).Route("/credentials", RestEndpoint{
+		Post: self.UserAuthenticated(self.RotateUserKey),
+		Docs: map[string]Operation{
+			"POST": {Summary: "Issue a new user key.", Response: UserCredentials{}},
+		},
+	}).Route("/github", RestEndpoint{
+		Post: self.UserAuthenticated(self.StartGithubAuthorization),
+		Docs: map[string]Operation{
+			"POST": {Summary: "Start linking a GitHub account.", Status: 201, Response: GithubAuthorization{}},
+		},
+	})
+}
+
+func (self *SidewinderDirector) GetUserDevices(userId string, writer http.ResponseWriter, request *http.Request) error {
+	devices, err := self.StoreWith(request.Context()).DevicesForUser(userId)
+	if err != nil {
+		return err
+	}
+	return writeJson(200, devices, writer, request)
+}
+
+func (self *SidewinderDirector) AttachUserDevice(userId string, writer http.ResponseWriter, request *http.Request) error {
+	var deviceMessage DeviceCredentials
+	violations, err := decodeJson(request, &deviceMessage)
+	if err != nil {
+		return err
+	}
+	violations.Check(isDeviceToken(deviceMessage.DeviceId), "DeviceId must be an APNS device token of 64 hexadecimal characters.")
+	violations.Check(deviceMessage.Key != "", "Key is required.")
+	if err := violations.Refusal(AttachDeviceMissingKeyError); err != nil {
+		return err
+	}
+
+	device, err := self.StoreWith(request.Context()).FindDevice(deviceMessage.DeviceId)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	} else if !device.HasKey(deviceMessage.Key) {
+		return DeviceForbiddenError
+	} else if device.UserId == userId {
+		return writeJson(200, device, writer, request)
+	} else if device.UserId != "" {
+		return AttachDeviceConflictError
+	}
+
+	attached, err := self.StoreWith(request.Context()).AttachDevice(userId, device.DeviceId)
+	if err != nil {
+		return err
+	} else if !attached {
+		return AttachDeviceConflictError
+	}
+	device.UserId = userId
+	return writeJson(201, device, writer, request)
+}
+
+func (self *SidewinderDirector) GetUserRepositories(userId string, writer http.ResponseWriter, request *http.Request) error {
+	repositories, err := self.StoreWith(request.Context()).RepositoriesForUser(userId)
+	if err != nil {
+		return err
+	}
+	return writeJson(200, repositories, writer, request)
+}
+
+func (self *SidewinderDirector) AddUserRepository(userId string, writer http.ResponseWriter, request *http.Request) error {
+	repositoryMessage, err := decodeSubscription(request)
+	if err != nil {
+		return err
+	}
+	if err := self.refuseMode(request.Context(), userId, repositoryMessage.Mode); err != nil {
+		return err
+	}
+	if refused, err := self.refuseSubscription(request.Context(), userId, repositoryMessage.Name); refused {
+		return err
+	}
+
+	wasInserted, err := self.StoreWith(request.Context()).AddUserToRepository(userId, repositoryMessage.Name, repositoryMessage.Mode)
+	if err != nil {
+		return err
+	}
+
+	return writeJson(insertCode(wasInserted), repositoryMessage, writer, request)
+}
+
+func (self *SidewinderDirector) RotateUserKey(userId string, writer http.ResponseWriter, request *http.Request) error {
+	key, err := newKey()
+	if err != nil {
+		return err
+	}
+	if err := self.StoreWith(request.Context()).SetUserKeyHash(userId, hashKey(key)); err != nil {
+		return err
+	}
+	return writeJson(200, UserCredentials{userId, key}, writer, request)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const MaxBodyBytes = 64 * 1024
+
+var UnsupportedMediaTypeError = NewApiError(415, CodeMediaType, "Request bodies must be sent as application/json.")
+var RequestTooLargeError = NewApiError(413, CodeTooLarge, fmt.Sprintf("Request bodies may not be larger than %v bytes.", MaxBodyBytes))
+
+var (
+	deviceTokenPattern  = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+	nameSegment         = `[A-Za-z0-9_.-]+`
+	ownerNamePattern    = regexp.MustCompile(`^` + nameSegment + `/(` + nameSegment + `|\*)$`)
+	teamPattern         = regexp.MustCompile(`^@` + nameSegment + `/` + nameSegment + `$`)
+	gitlabPathPattern   = regexp.MustCompile(`^` + nameSegment + `(/` + nameSegment + `)+$`)
+	sourcePrefixPattern = regexp.MustCompile(`^([a-z0-9-]+):(\S+)$`)
+)
+
+type Violations []string
+
+func (self *Violations) Check(valid bool, format string, args ...interface{}) {
+	if !valid {
+		*self = append(*self, fmt.Sprintf(format, args...))
+	}
+}
+
+func (self Violations) Refusal(apiError *ApiError) error {
+	if len(self) == 0 {
+		return nil
+	}
+	return apiError.WithDetails(self...)
+}
+
+func decodeJson(request *http.Request, value interface{}) (Violations, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, request.Body, MaxBodyBytes))
+	if _, tooLarge := err.(*http.MaxBytesError); tooLarge {
+		return nil, RequestTooLargeError
+	} else if err != nil {
+		return nil, err
+	} else if len(strings.TrimSpace(string(body))) == 0 {
+		return nil, nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return nil, UnsupportedMediaTypeError
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, InvalidJsonError.WithDetails(err.Error())
+	}
+
+	var violations Violations
+	known := jsonFieldNames(value)
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		violations.Check(containsFold(known, name), "Unknown field %q.", name)
+	}
+
+	if err := json.Unmarshal(body, value); err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			violations.Check(false, "%v must be a %v.", typeErr.Field, typeErr.Type.Kind())
+		} else {
+			return nil, InvalidJsonError.WithDetails(err.Error())
+		}
+	}
+	return violations, nil
+}
+
+func jsonFieldNames(value interface{}) []string {
+	valueType := reflect.TypeOf(value)
+	for valueType.Kind() == reflect.Ptr {
+		valueType = valueType.Elem()
+	}
+	if valueType.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var names []string
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" || field.PkgPath != "" {
+			continue
+		} else if name == "" {
+			name = field.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func containsFold(names []string, name string) bool {
+	for _, candidate := range names {
+		if strings.EqualFold(candidate, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDeviceToken(deviceId string) bool {
+	return deviceTokenPattern.MatchString(deviceId)
+}
+
+func isValidRepositoryName(name string) bool {
+	if ownerNamePattern.MatchString(name) || teamPattern.MatchString(name) {
+		return true
+	}
+
+	source := sourcePrefixPattern.FindStringSubmatch(name)
+	if source == nil {
+		return false
+	}
+	switch source[1] {
+	case GitlabProvider:
+		return gitlabPathPattern.MatchString(source[2])
+	case BitbucketProvider:
+		return ownerNamePattern.MatchString(source[2])
+	default:
+		return true
+	}
+}
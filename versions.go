@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+var LegacyDeprecatedAt = time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+
+type Deprecation struct {
+	Since     time.Time
+	Sunset    time.Time
+	Successor string
+}
+
+func (self *Deprecation) Annotate(writer http.ResponseWriter, request *http.Request) {
+	header := writer.Header()
+	header.Set("Deprecation", fmt.Sprintf("@%d", self.Since.Unix()))
+	if !self.Sunset.IsZero() {
+		header.Set("Sunset", self.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if self.Successor != "" {
+		header.Add("Link", fmt.Sprintf(`<%v%v>; rel="successor-version"`, self.Successor, request.URL.Path))
+	}
+}
+
+func (self *Deprecation) Wrap(handler web.Handler) web.Handler {
+	return web.HandlerFunc(func(context web.C, writer http.ResponseWriter, request *http.Request) {
+		self.Annotate(writer, request)
+		handler.ServeHTTPC(context, writer, request)
+	})
+}
+
+type ApiVersion struct {
+	Name     string
+	Endpoint *RestEndpoint
+}
+
+func (self ApiVersion) Prefix() string {
+	return "/" + self.Name
+}
+
+func (self *SidewinderDirector) ApiVersions() []ApiVersion {
+	return []ApiVersion{
+		{"v1", self.ApiV1()},
+	}
+}
+
+func (self *SidewinderDirector) MountApi(mux *web.Mux) {
+	versions := self.ApiVersions()
+	for _, version := range versions {
+		NewRestMux(version.Prefix(), mux).Use(version.Endpoint)
+		mux.Get(version.Prefix()+"/openapi.json", NewOpenApiDocument(version).Handler())
+	}
+	mux.Get("/openapi.json", NewOpenApiDocument(versions[len(versions)-1]).Handler())
+
+	legacy := versions[0]
+	NewRestMux("", mux).Deprecate(&Deprecation{
+		Since:     LegacyDeprecatedAt,
+		Sunset:    self.LegacySunset,
+		Successor: legacy.Prefix(),
+	}).Use(legacy.Endpoint)
+}